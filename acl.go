@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access levels of users, each allowing the commands of the levels below it too.
+const (
+	ACCESS_READ  = iota // Commands that don't change keys
+	ACCESS_WRITE        // Commands that change keys, see writeCommands
+	ACCESS_ADMIN        // Commands that act on the server, see adminCommands
+)
+
+var accessNames = []string{"read", "write", "admin"}
+
+// Parameters of the password hashes made by hashPassword.
+const (
+	PASSWORD_SCHEME     = "pbkdf2-sha256"
+	PASSWORD_ITERATIONS = 600000
+	PASSWORD_SALT_SIZE  = 16
+	PASSWORD_KEY_SIZE   = 32
+)
+
+var (
+	usersFile = flag.String("users", "",
+		`File of the users allowed in, one "<name> <password hash> <read|write|admin> [@<database>...] [<key prefix>...]" per line. Everyone has full access if empty.`)
+	hashPasswordFlag = flag.Bool("hashpassword", false,
+		"Read a password from the standard input, print its hash for the users file and exit.")
+)
+
+// A user can run the commands of its access level on the keys starting with one of its prefixes,
+// in the default database and the databases listed for it.
+type user struct {
+	name      string
+	hash      string // See hashPassword
+	access    int
+	databases []string // Databases selectable with use besides DEFAULT_DB, any of them for admins
+	prefixes  []string // All keys if empty
+}
+
+var users map[string]*user // Loaded from usersFile at startup, nil if authentication is off
+
+// Commands that need ACCESS_WRITE besides the mutating ones: they remove values or reach
+// other sessions.
+var writeCommands = map[string]bool{
+	"blpop":   true,
+	"brpop":   true,
+	"publish": true,
+}
+
+// Commands that need ACCESS_ADMIN.
+var adminCommands = map[string]bool{
+	"bgsave":   true,
+	"config":   true,
+	"save":     true,
+	"shutdown": true,
+}
+
+var errPasswordHash = errors.New("invalid password hash")
+
+// Returns a salted hash of a password to store in the users file:
+// PASSWORD_SCHEME$<iterations>$<salt>$<key>, with the salt and key in base64.
+func hashPassword(password string) string {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, PASSWORD_KEY_SIZE)
+	if err != nil {
+		panic(err)
+	}
+	return strings.Join([]string{PASSWORD_SCHEME, strconv.Itoa(PASSWORD_ITERATIONS),
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)}, "$")
+}
+
+// Parses a hash made by hashPassword.
+func parsePasswordHash(hash string) (iterations int, salt, key []byte, err error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != PASSWORD_SCHEME {
+		return 0, nil, nil, errPasswordHash
+	}
+	if iterations, err = strconv.Atoi(fields[1]); err != nil || iterations <= 0 {
+		return 0, nil, nil, errPasswordHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err == nil {
+		key, err = base64.RawStdEncoding.DecodeString(fields[3])
+	}
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errPasswordHash
+	}
+	return
+}
+
+// Reports whether a password matches a hash made by hashPassword.
+func checkPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	k, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(k, key) == 1
+}
+
+// Reads the users file. Empty lines and lines starting with # are ignored.
+// Fields after the access level starting with @ name databases, the others are key prefixes.
+func loadUsers(name string) (map[string]*user, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]*user)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected a name, a password hash and an access level", name, line)
+		}
+		u := &user{name: fields[0], hash: fields[1], access: -1}
+		for _, field := range fields[3:] {
+			if !strings.HasPrefix(field, "@") {
+				u.prefixes = append(u.prefixes, field)
+			} else if db := field[1:]; validDBName.MatchString(db) {
+				u.databases = append(u.databases, db)
+			} else {
+				return nil, fmt.Errorf("%s:%d: %v %s", name, line, errDBName, db)
+			}
+		}
+		if _, _, _, err := parsePasswordHash(u.hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		for i, access := range accessNames {
+			if fields[2] == access {
+				u.access = i
+			}
+		}
+		if u.access < 0 {
+			return nil, fmt.Errorf("%s:%d: access must be one of %s", name, line, strings.Join(accessNames, ", "))
+		}
+		if _, ok := users[u.name]; ok {
+			return nil, fmt.Errorf("%s:%d: user %s is already defined", name, line, u.name)
+		}
+		users[u.name] = u
+	}
+	return users, scanner.Err()
+}
+
+// Runs auth <user> <password>. The session keeps its user if the password is wrong.
+// Without a users file everyone has full access and auth always succeeds.
+func (s *Session) auth(args []string) string {
+	if len(args) != 3 {
+		return "-A"
+	}
+	if users == nil {
+		return APPLIED
+	}
+	u, ok := users[args[1]]
+	if !ok {
+		// take as long as for a wrong password, so that user names can't be told by timing
+		for _, other := range users {
+			checkPassword(other.hash, args[2])
+			break
+		}
+	} else if checkPassword(u.hash, args[2]) {
+		s.user = u
+		return APPLIED
+	}
+	logf(LOG_WARNING, "Failed authentication as %s\n", args[1])
+	return "-U"
+}
+
+// Checks that the user of the session may run a command: "-U" if the session has not
+// authenticated, "-D" if the command or one of its keys is beyond the user's rights.
+func (s *Session) authorize(cmd string, args []string) string {
+	if users == nil || cmd == "auth" || cmd == "quit" {
+		return APPLIED
+	}
+	u := s.user
+	if u == nil {
+		return "-U"
+	}
+	access := ACCESS_READ
+	if adminCommands[cmd] {
+		access = ACCESS_ADMIN
+	} else if mutating[cmd] || writeCommands[cmd] {
+		access = ACCESS_WRITE
+	}
+	if access > u.access || !u.mayTouch(cmd, args) {
+		return "-D"
+	}
+	if cmd == "use" && len(args) > 1 && !u.mayUse(args[1]) {
+		return "-D"
+	}
+	return APPLIED
+}
+
+// Reports whether the user may select a database, which opens it or creates its files.
+func (u *user) mayUse(db string) bool {
+	if db == DEFAULT_DB || u.access == ACCESS_ADMIN {
+		return true
+	}
+	for _, name := range u.databases {
+		if name == db {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a command only touches keys starting with one of the user's prefixes.
+// Commands reading keys by pattern or range are allowed if every key they can return does.
+// dbsize is only allowed to users without prefixes.
+func (u *user) mayTouch(cmd string, args []string) bool {
+	if len(u.prefixes) == 0 {
+		return true
+	}
+	if n, ok := argc[cmd]; !ok || len(args)-1 < n {
+		// rejected by the argc check anyway
+		return true
+	}
+	switch cmd {
+	case "dbsize":
+		return false
+	case "keys":
+		return u.owns(literalPrefix(args[1]))
+	case "scan":
+		_, pattern, _, ok := scanArgs(args)
+		return ok && u.owns(literalPrefix(pattern))
+	case "prefix", "revprefix":
+		return u.owns(args[1])
+	case "range", "revrange":
+		for _, p := range u.prefixes {
+			end := prefixEnd(p)
+			if strings.HasPrefix(args[1], p) && (end == "" || (args[2] != "" && args[2] <= end)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, key := range aclKeys(cmd, args) {
+		if !u.owns(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether a key starts with one of the user's prefixes.
+func (u *user) owns(key string) bool {
+	for _, p := range u.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the keys (or key prefixes, for watchkeys) a command touches. Unlike commandKeys
+// it also covers commands that don't go through the shard locks.
+func aclKeys(cmd string, args []string) []string {
+	switch {
+	case blockingCommands[cmd] && cmd != "waitkey":
+		return args[1 : len(args)-1]
+	case cmd == "watch" || cmd == "watchkeys" || cmd == "unwatchkeys":
+		return args[1:]
+	case pubsubCommands[cmd] || txCommands[cmd] || cmd == "config" || cmd == "shutdown" || saveCommands[cmd]:
+		return nil
+	}
+	return commandKeys(cmd, args)
+}
+
+// Returns the part of a glob pattern before its first special character.
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
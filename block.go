@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/marella/godb/wire"
+	"strconv"
+	"time"
+)
+
+// Commands that wait for keys to be written.
+var blockingCommands = map[string]bool{
+	"blpop":   true,
+	"brpop":   true,
+	"waitkey": true,
+}
+
+// Runs blpop, brpop and waitkey:
+//
+//	blpop <key> [<key> ...] <timeout>   ->  list of the key and the value popped from the first non-empty list
+//	brpop <key> [<key> ...] <timeout>   ->  same, popping from the tail
+//	waitkey <key> <timeout>             ->  APPLIED once the key is set
+//
+// timeout is in seconds and may have a fraction, 0 waits forever. NOT_APPLIED is returned when
+// it expires or the connection of the session is closed.
+// The session waits on a channel that touch signals whenever one of the keys is written, so
+// it checks the keys again only after they changed.
+func (s *Session) blockingCommand(cmd string, args []string) string {
+	keys := args[1 : len(args)-1]
+	secs, err := strconv.ParseFloat(args[len(args)-1], 64)
+	if err != nil || secs < 0 || (cmd == "waitkey" && len(keys) != 1) {
+		return "-A"
+	}
+	var timeout <-chan time.Time
+	if secs > 0 {
+		timer := time.NewTimer(time.Duration(secs * float64(time.Second)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	d := s.db
+	wake := make(chan struct{}, 1)
+	for registered := false; ; registered = true {
+		unlock := d.lock(keys, true)
+		response, done := d.tryBlocking(cmd, keys)
+		if !done && !registered {
+			d.block(keys, wake)
+		}
+		unlock()
+		if done {
+			if registered {
+				d.unblock(keys, wake)
+			}
+			return response
+		}
+
+		select {
+		case <-wake:
+		case <-timeout:
+			d.unblock(keys, wake)
+			return NOT_APPLIED
+		case <-s.closed:
+			d.unblock(keys, wake)
+			return NOT_APPLIED
+		}
+	}
+}
+
+// Runs a blocking command if one of its keys is ready. done is false if it has to wait.
+// Values popped are logged as lpop or rpop commands. The caller must hold the write locks
+// of the shards of the keys.
+func (d *DB) tryBlocking(cmd string, keys []string) (response string, done bool) {
+	for _, key := range keys {
+		switch t := d.typeOf(key); {
+		case t == TYPE_NONE:
+			continue
+		case cmd == "waitkey":
+			return APPLIED, true
+		case t != TYPE_LIST:
+			return "-Y", true
+		}
+
+		args := []string{cmd[1:], key} // lpop or rpop
+		if d.wal != nil {
+			if err := d.wal.Append(args); err != nil {
+				return "-W", true
+			}
+		}
+		r, _ := d.execute(args)
+		d.written(args, r)
+		return wire.EncodeList([]string{key, r[1:]}), true
+	}
+	return "", false
+}
+
+// Registers a channel to be signalled when one of the keys is written.
+func (d *DB) block(keys []string, wake chan struct{}) {
+	for _, key := range keys {
+		sh := d.shardOf(key)
+		sh.blocked[key] = append(sh.blocked[key], wake)
+	}
+}
+
+func (d *DB) unblock(keys []string, wake chan struct{}) {
+	unlock := d.lock(keys, true)
+	defer unlock()
+	for _, key := range keys {
+		sh := d.shardOf(key)
+		waiting := sh.blocked[key][:0]
+		for _, ch := range sh.blocked[key] {
+			if ch != wake {
+				waiting = append(waiting, ch)
+			}
+		}
+		if len(waiting) == 0 {
+			delete(sh.blocked, key)
+		} else {
+			sh.blocked[key] = waiting
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default snapshot policy: after an hour if a key changed, after 5 minutes if 100 did
+	// and after a minute if 10000 did.
+	SAVE_POLICY = "3600 1 300 100 60 10000"
+
+	SAVE_RETRY_INTERVAL = 5 * time.Second // How long the snapshotter waits after a failed snapshot
+
+	WAL_SIZE = 64 << 20 // Default walsize setting
+)
+
+var errSavePolicy = errors.New("invalid snapshot policy")
+
+// A saveRule asks for a snapshot once changes writes are older than seconds.
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+// Commands that write snapshots on demand or report when the last one was written.
+var saveCommands = map[string]bool{
+	"bgsave":   true,
+	"lastsave": true,
+	"save":     true,
+}
+
+// Parses a snapshot policy such as SAVE_POLICY.
+func parseSavePolicy(policy string) ([]saveRule, error) {
+	fields := strings.Fields(policy)
+	if len(fields)%2 != 0 {
+		return nil, errSavePolicy
+	}
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errSavePolicy
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errSavePolicy
+		}
+		rules = append(rules, saveRule{seconds, changes})
+	}
+	return rules, nil
+}
+
+// Snapshots every open database whose writes since its last snapshot satisfy one of the rules
+// of the save setting, or whose write-ahead log grew by more than the walsize setting since.
+// The write-ahead log of a database only keeps the records the previous snapshot does not hold.
+func snapshotter() {
+	failed := make(map[*DB]time.Time)
+	for now := range time.Tick(time.Second) {
+		rules := savePolicy.rules()
+		for _, d := range openDBs() {
+			if !d.due(rules, now) || now.Sub(failed[d]) < SAVE_RETRY_INTERVAL {
+				continue
+			}
+			if err := d.checkpoint(); err == errSaving {
+				continue
+			} else if err != nil {
+				logf(LOG_ERROR, "Snapshot of %s failed: %s\n", d.name, err.Error())
+				failed[d] = now
+			} else {
+				delete(failed, d)
+			}
+		}
+	}
+}
+
+// Reports whether the writes since the last snapshot satisfy one of the rules or the
+// write-ahead log outgrew the walsize setting.
+func (d *DB) due(rules []saveRule, now time.Time) bool {
+	if d.wal != nil && walSize.exceeded(int(d.wal.Size()-atomic.LoadInt64(&d.walSaved))) {
+		return true
+	}
+	changes := atomic.LoadInt64(&d.dirty)
+	elapsed := now.Unix() - atomic.LoadInt64(&d.lastSave)
+	for _, rule := range rules {
+		if changes >= rule.changes && elapsed >= rule.seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a write applied to the database and sends its keyspace events.
+// Failed and read-only commands are ignored.
+func (d *DB) written(args []string, response string) {
+	if !mutating[strings.ToLower(args[0])] || strings.HasPrefix(response, "-") || response == NOT_APPLIED {
+		return
+	}
+	atomic.AddInt64(&d.dirty, 1)
+	d.notify(args)
+}
+
+var errSaving = errors.New("a snapshot is already being written")
+
+// Runs save, bgsave and lastsave.
+func (s *Session) saveCommand(cmd string) string {
+	d := s.db
+	switch cmd {
+	case "save":
+		d.saving.Lock()
+		defer d.saving.Unlock()
+		if err := d.writeCheckpoint(); err != nil {
+			logf(LOG_ERROR, "Snapshot of %s failed: %s\n", d.name, err.Error())
+			return "-W"
+		}
+	case "bgsave":
+		if !d.saving.TryLock() {
+			return NOT_APPLIED
+		}
+		go func() {
+			defer d.saving.Unlock()
+			if err := d.writeCheckpoint(); err != nil {
+				logf(LOG_ERROR, "Snapshot of %s failed: %s\n", d.name, err.Error())
+			}
+		}()
+	case "lastsave":
+		return "R" + strconv.FormatInt(atomic.LoadInt64(&d.lastSave), 10)
+	}
+	return APPLIED
+}
+
+// Writes a snapshot of the database and discards the write-ahead log records the previous one holds.
+// Returns errSaving if another snapshot is being written.
+func (d *DB) checkpoint() error {
+	if !d.saving.TryLock() {
+		return errSaving
+	}
+	defer d.saving.Unlock()
+	return d.writeCheckpoint()
+}
+
+// Same as checkpoint. The caller must hold d.saving.
+func (d *DB) writeCheckpoint() error {
+	snap, changes := d.startView()
+	d.finishView(snap)
+	if err := writeSnapshot(d.file, snap); err != nil {
+		return err
+	}
+	if err := d.discardSaved(snap.Seq); err != nil {
+		return err
+	}
+	atomic.AddInt64(&d.dirty, -changes)
+	atomic.StoreInt64(&d.lastSave, time.Now().Unix())
+	return nil
+}
+
+// Discards the write-ahead log records held by the previous snapshot once a snapshot of the
+// records up to seq has been written. The records since the previous snapshot are kept, so that
+// LoadDB can still fall back to it if the new one turns out to be corrupt.
+// The caller must hold d.saving.
+func (d *DB) discardSaved(seq uint64) error {
+	prev := d.snapSeq
+	d.snapSeq = seq
+	if d.wal == nil {
+		return nil
+	}
+	err := d.wal.Discard(prev)
+	atomic.StoreInt64(&d.walSaved, d.wal.Size())
+	return err
+}
+
+// Starts a snapshot of the contents of the database as they are now. changes is the number of
+// writes the snapshot holds. Every shard keeps the values of keys before their first write
+// (see preserve) until finishView has copied it, so writers are only blocked for as long as it
+// takes to copy one shard.
+func (d *DB) startView() (snap *Snapshot, changes int64) {
+	snap = newSnapshot()
+	unlock := d.rlockAll()
+	for _, s := range d.shards {
+		s.cow = make(map[string]saved)
+	}
+	if d.wal != nil {
+		snap.Seq = d.wal.Seq()
+	}
+	changes = atomic.LoadInt64(&d.dirty)
+	unlock()
+	return
+}
+
+// Copies the shards into a snapshot begun by startView.
+func (d *DB) finishView(snap *Snapshot) {
+	for _, s := range d.shards {
+		s.mu.RLock()
+		for k, v := range s.data {
+			if _, ok := s.cow[k]; !ok {
+				snap.add(k, v)
+			}
+		}
+		for k, obj := range s.objects {
+			if _, ok := s.cow[k]; !ok {
+				snap.add(k, obj)
+			}
+		}
+		for k, t := range s.expires {
+			if _, ok := s.cow[k]; !ok {
+				snap.Expires[k] = t
+			}
+		}
+		for k, st := range s.cow {
+			if st.ok {
+				snap.add(k, st.v)
+			} else if st.obj != nil {
+				snap.add(k, st.obj)
+			}
+			if st.hasDeadline {
+				snap.Expires[k] = st.deadline
+			}
+		}
+		s.mu.RUnlock()
+
+		s.mu.Lock()
+		s.cow = nil
+		s.mu.Unlock()
+	}
+}
+
+// Keeps the value of a key as it was when startView began a snapshot, before the key is first
+// written. The caller must hold the write lock of the shard of the key.
+func (d *DB) preserve(key string) {
+	s := d.shardOf(key)
+	if s.cow == nil {
+		return
+	}
+	if _, ok := s.cow[key]; !ok {
+		s.cow[key] = d.save([]string{key})[0]
+	}
+}
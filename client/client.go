@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"bufio"
 	"os"
+	"time"
 	"github.com/marella/godb/godb"
 )
 
 func main() {
-	g := godb.New("127.0.0.1", "db_name")
+	g, err := godb.Dial(context.Background(), "127.0.0.1", godb.WithDialTimeout(5*time.Second))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer g.Close()
 	s := "start"
 	scanner := bufio.NewScanner(os.Stdin)
 	for s != "quit" {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+)
+
+// Responses of conditional commands.
+const (
+	APPLIED     = "1"
+	NOT_APPLIED = "0" // The condition of setnx, setxx or cas did not hold
+)
+
+// Sets the value of a key from the arguments written by normalize or respSet: the value,
+// optionally followed by "pxat" and a deadline or by "keepttl". Any previous expiry is removed
+// unless keepttl is given.
+// The caller must hold the write lock of the shard of the key.
+func (d *DB) set(key string, args []string) {
+	switch {
+	case len(args) == 3 && args[1] == "pxat":
+		d.clearDeadline(key)
+		d.store(key, args[0])
+		d.setExpiry(key, args[2])
+	case len(args) == 2 && args[1] == "keepttl":
+		d.store(key, args[0])
+	default:
+		d.clearDeadline(key)
+		d.store(key, strings.Join(args, " "))
+	}
+}
+
+// Sets a key only if it is not set (setnx) or only if it is set (setxx).
+func (d *DB) setIf(key string, exists bool, args []string) string {
+	if d.exists(key) != exists {
+		return NOT_APPLIED
+	}
+	d.set(key, args)
+	return APPLIED
+}
+
+// Sets a key to a new value only if its current value is old.
+func (d *DB) cas(key, old string, args []string) string {
+	if v, ok := d.lookup(key); !ok || v != old {
+		return NOT_APPLIED
+	}
+	d.set(key, args)
+	return APPLIED
+}
+
+// Sets a key and returns its previous value, or APPLIED if it was not set.
+func (d *DB) getSet(key, value string) string {
+	v, ok := d.lookup(key)
+	d.set(key, []string{value})
+	if ok {
+		return "R" + v
+	}
+	return APPLIED
+}
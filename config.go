@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/marella/godb/wire"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Log levels, see logf.
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARNING
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+var (
+	configFile = flag.String("config", "",
+		`File of settings, one "<name> <value>" per line, named as the flags. Flags given on the command line take precedence.`)
+
+	listenAddr = flag.String("addr", ":"+GODB_PORT, "Address to serve godb clients on.")
+	dataDir    = flag.String("dir", ".", "Directory of the snapshot and write-ahead log files. Created if missing.")
+	respAddr   = flag.String("resp", "", "Address to serve the Redis protocol (RESP) on, e.g. :6379. Disabled if empty.")
+
+	savePolicy = &policyValue{}
+	maxClients = &limitValue{}
+	maxValue   = &limitValue{}
+	maxFrame   = &limitValue{wire.MAX_FRAME}
+	walSize    = &limitValue{WAL_SIZE}
+	logLevel   = &levelValue{LOG_INFO}
+)
+
+func init() {
+	savePolicy.Set(SAVE_POLICY)
+	flag.Var(savePolicy, "save",
+		`Snapshot policy as pairs of "<seconds> <changes>": a database is saved when at least that many writes happened in that many seconds since its last snapshot. Disabled if empty.`)
+	flag.Var(maxClients, "maxclients", "Largest number of connected clients. 0 means no limit.")
+	flag.Var(maxFrame, "maxframe", "Largest request accepted from a client, in bytes. 0 means 2 GiB.")
+	flag.Var(maxValue, "maxvalue", "Largest key or value written by a command, in bytes. 0 means no limit besides the frame size.")
+	flag.Var(walSize, "walsize",
+		"Size in bytes the write-ahead log of a database may grow to since its last snapshot before a snapshot is written, whatever the save policy. 0 means no limit.")
+	flag.Var(logLevel, "loglevel", "Least severe messages logged: debug, info, warning or error.")
+}
+
+// Settings shown by config get. Only the ones in configTunable can be changed by config set,
+// the others are read once when the server starts.
+var configNames = []string{"addr", "dir", "loglevel", "maxclients", "maxframe", "maxvalue", "resp", "save",
+	"tlsca", "tlscert", "tlsclientauth", "tlskey", "users", "walsize"}
+
+var configTunable = map[string]bool{
+	"loglevel":   true,
+	"maxclients": true,
+	"maxframe":   true,
+	"maxvalue":   true,
+	"save":       true,
+	"walsize":    true,
+}
+
+var configMu sync.Mutex // Serializes config set
+
+var errConfigLine = errors.New("expected a setting name followed by its value")
+
+// Applies the settings of a config file that were not given as flags.
+// Empty lines and lines starting with # are ignored. Values may be double-quoted.
+func loadConfig(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: %v", name, line, errConfigLine)
+		}
+		setting, value := fields[0], strings.TrimSpace(fields[1])
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+		}
+		if !isConfigName(setting) {
+			return fmt.Errorf("%s:%d: unknown setting %s", name, line, setting)
+		}
+		if given[setting] {
+			continue
+		}
+		if err := flag.Set(setting, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func isConfigName(name string) bool {
+	for _, n := range configNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs config get <pattern> and config set <name> <value>.
+// get returns the names matching a glob pattern, each followed by its value.
+func configCommand(args []string) string {
+	switch strings.ToLower(args[1]) {
+	case "get":
+		if len(args) != 3 {
+			return "-A"
+		}
+		configMu.Lock()
+		defer configMu.Unlock()
+		var items []string
+		for _, name := range configNames {
+			if match(args[2], name) {
+				items = append(items, name, flag.Lookup(name).Value.String())
+			}
+		}
+		return wire.EncodeList(items)
+	case "set":
+		name := strings.ToLower(args[2])
+		if len(args) != 4 || !configTunable[name] {
+			return "-A"
+		}
+		configMu.Lock()
+		defer configMu.Unlock()
+		if err := flag.Lookup(name).Value.Set(args[3]); err != nil {
+			return "-A"
+		}
+		logf(LOG_INFO, "Set %s to %s\n", name, args[3])
+		return APPLIED
+	}
+	return "-A"
+}
+
+// Reports whether one of the arguments of a write is longer than the maxvalue setting.
+func tooLarge(args []string) bool {
+	for _, arg := range args {
+		if maxValue.exceeded(len(arg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the maxframe setting as the limit of wire.ReadFrame.
+func frameLimit() int {
+	if n := maxFrame.get(); n > 0 && n < math.MaxInt32 {
+		return int(n)
+	}
+	return math.MaxInt32
+}
+
+// Logs a message if its level is at least the loglevel setting.
+func logf(level int32, format string, a ...interface{}) {
+	if level >= logLevel.get() {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
+
+// A limitValue is a size or count setting, 0 meaning no limit.
+// It can be read while config set changes it.
+type limitValue struct {
+	n int64
+}
+
+func (v *limitValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return errors.New("expected a number of at least 0")
+	}
+	atomic.StoreInt64(&v.n, n)
+	return nil
+}
+
+func (v *limitValue) String() string {
+	return strconv.FormatInt(v.get(), 10)
+}
+
+func (v *limitValue) get() int64 {
+	return atomic.LoadInt64(&v.n)
+}
+
+// Reports whether n exceeds the limit.
+func (v *limitValue) exceeded(n int) bool {
+	limit := v.get()
+	return limit > 0 && int64(n) > limit
+}
+
+// A levelValue is one of the LOG_* levels, set by name.
+type levelValue struct {
+	level int32
+}
+
+func (v *levelValue) Set(s string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			atomic.StoreInt32(&v.level, int32(i))
+			return nil
+		}
+	}
+	return errors.New("expected one of " + strings.Join(logLevelNames, ", "))
+}
+
+func (v *levelValue) String() string {
+	return logLevelNames[v.get()]
+}
+
+func (v *levelValue) get() int32 {
+	return atomic.LoadInt32(&v.level)
+}
+
+// A policyValue is a snapshot policy, see parseSavePolicy.
+type policyValue struct {
+	mu     sync.Mutex
+	policy string
+	parsed []saveRule
+}
+
+func (v *policyValue) Set(s string) error {
+	rules, err := parseSavePolicy(s)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.policy = strings.Join(strings.Fields(s), " ")
+	v.parsed = rules
+	return nil
+}
+
+func (v *policyValue) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.policy
+}
+
+func (v *policyValue) rules() []saveRule {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.parsed
+}
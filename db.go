@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Database used by clients that don't select one. Its files are DB_FILE and WAL_FILE.
+const DEFAULT_DB = "default"
+
+var errDBName = errors.New("invalid database name")
+
+// Names of databases, also used in their file names.
+var validDBName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// A DB is a named key-value map with its own snapshot file and write-ahead log.
+// Its keys are partitioned into shards which are locked independently.
+type DB struct {
+	name   string
+	shards []*shard
+	wal    *WAL
+	file   string // Snapshot file
+
+	watched int32 // Number of key prefixes watched by sessions, see notify
+	clock   int64 // Time of the log record being replayed, see replay
+
+	snapSeq  uint64     // Log position held by the snapshot file, see discardSaved
+	walSaved int64      // Size of the write-ahead log after the last snapshot
+	dirty    int64      // Writes since the last snapshot
+	lastSave int64      // Unix time of the last snapshot, or of when the database was opened
+	saving   sync.Mutex // Held while a snapshot is written
+}
+
+var (
+	dbs   = make(map[string]*DB) // Databases opened so far
+	dbsMu sync.Mutex             // To protect dbs
+)
+
+// Returns the database with the given name, loading it from its snapshot file and
+// write-ahead log the first time it is used.
+func openDB(name string) (d *DB, err error) {
+	if !validDBName.MatchString(name) {
+		return nil, errDBName
+	}
+	dbsMu.Lock()
+	defer dbsMu.Unlock()
+	if d, ok := dbs[name]; ok {
+		return d, nil
+	}
+
+	d = newDB(name)
+	seq, err := d.LoadDB()
+	if err != nil {
+		return nil, err
+	}
+	d.wal, err = OpenWAL(dbFile(name, WAL_FILE))
+	if err != nil {
+		return nil, err
+	}
+	err = d.wal.Replay(seq, func(args []string) {
+		d.replay(args)
+		d.dirty++
+	})
+	if err != nil {
+		d.wal.Close()
+		return nil, err
+	}
+	dbs[name] = d
+	return d, nil
+}
+
+// Creates an empty database that is not backed by files yet.
+func newDB(name string) *DB {
+	return &DB{
+		name:     name,
+		shards:   newShards(),
+		file:     dbFile(name, DB_FILE),
+		lastSave: time.Now().Unix(),
+	}
+}
+
+// Returns the path of a file used by a database in the dir setting: DB_FILE and WAL_FILE for
+// the default database and db.<name>.txt, db.<name>.wal for the others.
+func dbFile(name, file string) string {
+	if name != DEFAULT_DB {
+		ext := filepath.Ext(file)
+		file = strings.TrimSuffix(file, ext) + "." + name + ext
+	}
+	return filepath.Join(*dataDir, file)
+}
+
+// Returns the open databases sorted by name.
+func openDBs() []*DB {
+	dbsMu.Lock()
+	defer dbsMu.Unlock()
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*DB, len(names))
+	for i, name := range names {
+		list[i] = dbs[name]
+	}
+	return list
+}
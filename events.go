@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// A key prefix watched on a database.
+type keyPrefix struct {
+	db     *DB
+	prefix string
+}
+
+// Subscribers watching keys of each database. Protected by pubsubMu.
+var keyWatchers = make(map[*DB]map[*subscriber]bool)
+
+// Types of the events sent for each mutating command, for the keys returned by commandKeys.
+// Other commands send an event named after the command for their key.
+var eventTypes = map[string][]string{
+	"cas":       {"set"},
+	"copy":      {"", "copy_to"},
+	"decr":      {"incrby"},
+	"decrby":    {"incrby"},
+	"getset":    {"set"},
+	"incr":      {"incrby"},
+	"pexpireat": {"expire"},
+	"rename":    {"rename_from", "rename_to"},
+	"setnx":     {"set"},
+	"setxx":     {"set"},
+}
+
+// Sends keyspace events for a write that was applied (see written) to the sessions watching a prefix
+// of its keys. An event holds its type, the key and the new value of the key if it holds a string.
+// Keys deleted by the sweeper send an "expired" event.
+// The caller must hold the locks of the shards of the keys, so that events are sent in the
+// order the keys changed.
+func (d *DB) notify(args []string) {
+	cmd := strings.ToLower(args[0])
+	if atomic.LoadInt32(&d.watched) == 0 {
+		return
+	}
+	types, ok := eventTypes[cmd]
+	if !ok {
+		types = []string{cmd}
+	}
+	for i, key := range commandKeys(cmd, args) {
+		if i < len(types) && types[i] != "" {
+			v, _ := d.lookup(key)
+			d.emit(types[i], key, v)
+		}
+	}
+}
+
+// Sends an event to the sessions watching a prefix of key.
+func (d *DB) emit(event, key, value string) {
+	if atomic.LoadInt32(&d.watched) == 0 {
+		return
+	}
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+	for sub := range keyWatchers[d] {
+		for kp := range sub.prefixes {
+			if kp.db == d && strings.HasPrefix(key, kp.prefix) {
+				sub.send([]string{"event", event, key, value})
+				break
+			}
+		}
+	}
+}
+
+// Watches the keys starting with a prefix. Requires pubsubMu to be locked.
+func (sub *subscriber) watchKeys(kp keyPrefix) {
+	if sub.prefixes[kp] {
+		return
+	}
+	sub.prefixes[kp] = true
+	if keyWatchers[kp.db] == nil {
+		keyWatchers[kp.db] = make(map[*subscriber]bool)
+	}
+	keyWatchers[kp.db][sub] = true
+	atomic.AddInt32(&kp.db.watched, 1)
+}
+
+// Stops watching the keys starting with a prefix. Requires pubsubMu to be locked.
+func (sub *subscriber) unwatchKeys(kp keyPrefix) {
+	if !sub.prefixes[kp] {
+		return
+	}
+	delete(sub.prefixes, kp)
+	atomic.AddInt32(&kp.db.watched, -1)
+	for other := range sub.prefixes {
+		if other.db == kp.db {
+			return
+		}
+	}
+	delete(keyWatchers[kp.db], sub)
+	if len(keyWatchers[kp.db]) == 0 {
+		delete(keyWatchers, kp.db)
+	}
+}
+
+// Returns prefixes, or all the prefixes watched on the database if there are none.
+func (sub *subscriber) watched(d *DB, prefixes []string) []string {
+	if len(prefixes) > 0 {
+		return prefixes
+	}
+	for kp := range sub.prefixes {
+		if kp.db == d {
+			prefixes = append(prefixes, kp.prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the background sweeper removes expired keys.
+const SWEEP_INTERVAL = time.Second
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Rewrites relative expiry arguments into absolute deadlines so that replaying the
+// write-ahead log later gives the same deadlines:
+//
+//	set <key> <value...> ex <seconds>       ->  set <key> <value> pxat <ms>
+//	cas <key> <old> <new> ex <seconds>      ->  cas <key> <old> <new> pxat <ms>
+//	expire <key> <seconds>                  ->  pexpireat <key> <ms>
+//
+// The same applies to setnx and setxx. The value of set, setnx, setxx and getset is joined
+// into a single argument. ok is false if the arguments are malformed.
+func normalize(args []string) (out []string, ok bool) {
+	switch strings.ToLower(args[0]) {
+	case "set", "setnx", "setxx":
+		n := len(args)
+		if n >= 5 && strings.ToLower(args[n-2]) == "ex" {
+			if secs, err := strconv.ParseInt(args[n-1], 10, 64); err == nil {
+				value := strings.Join(args[2:n-2], " ")
+				return []string{args[0], args[1], value, "pxat", deadline(secs)}, true
+			}
+		}
+		return []string{args[0], args[1], strings.Join(args[2:], " ")}, true
+
+	case "getset":
+		return []string{args[0], args[1], strings.Join(args[2:], " ")}, true
+
+	case "cas":
+		if len(args) == 4 {
+			return args, true
+		}
+		if len(args) != 6 || strings.ToLower(args[4]) != "ex" {
+			return nil, false
+		}
+		secs, err := strconv.ParseInt(args[5], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return []string{args[0], args[1], args[2], args[3], "pxat", deadline(secs)}, true
+
+	case "expire":
+		secs, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return []string{"pexpireat", args[1], deadline(secs)}, true
+	}
+	return args, true
+}
+
+func deadline(secs int64) string {
+	return strconv.FormatInt(now()+secs*1000, 10)
+}
+
+// Prefixes a log record with the time it is written, so that replaying the write-ahead log
+// later checks which keys had expired as of that time rather than the time of the replay:
+//
+//	<command> <args...>  ->  at <now> <command> <args...>
+func stamp(args []string) []string {
+	return append([]string{"at", strconv.FormatInt(now(), 10)}, args...)
+}
+
+// Applies a record of the write-ahead log as of the time stamp added to it.
+// Records logged without one are applied as of now.
+func (d *DB) replay(record []string) {
+	if len(record) > 2 && record[0] == "at" {
+		if t, err := strconv.ParseInt(record[1], 10, 64); err == nil {
+			d.clock = t
+			defer func() { d.clock = 0 }()
+		}
+		record = record[2:]
+	}
+	d.execute(record)
+}
+
+// Current time in milliseconds, or the time of the record being replayed.
+func (d *DB) now() int64 {
+	if d.clock != 0 {
+		return d.clock
+	}
+	return now()
+}
+
+// Sets the deadline of a key from an argument written by normalize.
+// The caller must hold the lock of the shard of the key.
+func (d *DB) setExpiry(key string, ms string) {
+	t, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return
+	}
+	d.setDeadline(key, t)
+}
+
+// Seconds until the key expires, rounded up, or -1 if it has no deadline.
+// The caller must hold the lock of the shard of the key.
+func (d *DB) ttl(key string) int64 {
+	deadline, ok := d.deadline(key)
+	if !ok {
+		return -1
+	}
+	return (deadline - now() + 999) / 1000
+}
+
+// Deletes expired keys of all open databases every SWEEP_INTERVAL so that keys which are
+// never accessed again don't stay in memory and in snapshots.
+func sweepExpired() {
+	for range time.Tick(SWEEP_INTERVAL) {
+		for _, d := range openDBs() {
+			d.sweep()
+		}
+	}
+}
+
+func (d *DB) sweep() {
+	for _, s := range d.shards {
+		s.mu.Lock()
+		t := now()
+		for key, deadline := range s.expires {
+			if deadline <= t {
+				d.remove(key)
+				d.emit("expired", key, "")
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// Reports whether s matches the glob pattern. In the pattern '*' matches any sequence of
+// bytes (including '/'), '?' any single byte, [abc] one of the bytes listed, [a-z] a range
+// and [^a] any byte not listed. A backslash matches the byte that follows it.
+//
+// A '*' first matches nothing and is only extended one byte at a time when the rest of the
+// pattern fails, going back to the last '*' alone, so matching takes O(len(pattern)*len(s)).
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0 // Pattern position after the last '*' and the position in s it matches up to
+	for p < len(pattern) || i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				p++
+				star, next = p, i
+				continue
+
+			case '?':
+				if i < len(s) {
+					p++
+					i++
+					continue
+				}
+
+			case '[':
+				if i < len(s) {
+					if n, ok := matchClass(pattern[p:], s[i]); ok {
+						p += n
+						i++
+						continue
+					}
+				}
+
+			default:
+				if c == '\\' && p+1 < len(pattern) {
+					p++
+				}
+				if i < len(s) && s[i] == pattern[p] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		// let the last '*' match one more byte and try the rest of the pattern again
+		if star < 0 || next >= len(s) {
+			return false
+		}
+		next++
+		p, i = star, next
+	}
+	return true
+}
+
+// Matches c against the class at the start of pattern. n is the length of the class.
+// An unterminated class matches a literal '['.
+func matchClass(pattern string, c byte) (n int, ok bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	found := false
+	for first := true; i < len(pattern) && (first || pattern[i] != ']'); first = false {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		found = found || (lo <= c && c <= hi)
+		i++
+	}
+	if i >= len(pattern) {
+		return 1, c == '['
+	}
+	return i + 1, found != negate
+}
@@ -0,0 +1,93 @@
+package godb
+
+import (
+	"github.com/marella/godb/wire"
+	"strconv"
+	"time"
+)
+
+// Removes and returns the first value of the first non-empty list among keys, waiting for
+// one of them to get a value if they are all empty. Returns ErrTimeout if none did within
+// timeout; zero waits forever.
+// The connection's read timeout is extended by timeout while waiting.
+func (g *Godb) BLPop(timeout time.Duration, keys ...string) (key, value string, err error) {
+	return g.bpop("blpop", timeout, keys)
+}
+
+// Same as BLPop, removing the last value of the list.
+func (g *Godb) BRPop(timeout time.Duration, keys ...string) (key, value string, err error) {
+	return g.bpop("brpop", timeout, keys)
+}
+
+// Waits for a key to be set, with any type of value. Returns ErrTimeout if it was not
+// within timeout; zero waits forever.
+func (g *Godb) WaitKey(key string, timeout time.Duration) error {
+	s, err := g.wait("waitkey "+Quote(key), timeout)
+	if err != nil {
+		return err
+	}
+	if s == "0" {
+		return ErrTimeout
+	}
+	_, err = decode(s)
+	return err
+}
+
+func (g *Godb) bpop(cmd string, timeout time.Duration, keys []string) (key, value string, err error) {
+	if len(keys) == 0 {
+		return "", "", ErrArgs
+	}
+	q := keysQuery(cmd, keys...)
+	s, err := g.wait(q, timeout)
+	if err != nil {
+		return
+	}
+	if s == "0" {
+		return "", "", ErrTimeout
+	}
+	if _, err = decode(s); err != nil {
+		return
+	}
+	items, ok := wire.DecodeList(s)
+	if !ok || len(items) != 2 {
+		return "", "", ServerError(s)
+	}
+	return items[0], items[1], nil
+}
+
+// Sends a blocking command with its timeout and returns the raw response.
+func (g *Godb) wait(query string, timeout time.Duration) (string, error) {
+	query += " " + strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+	readTimeout := g.opts.readTimeout
+	if readTimeout > 0 {
+		if timeout == 0 {
+			readTimeout = 0
+		} else {
+			readTimeout += timeout
+		}
+	}
+	return g.exchange(query, readTimeout)
+}
+
+// Same as Godb.BLPop on a pooled connection.
+func (p *Pool) BLPop(timeout time.Duration, keys ...string) (key, value string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		key, value, err = g.BLPop(timeout, keys...)
+		return
+	})
+	return
+}
+
+// Same as Godb.BRPop on a pooled connection.
+func (p *Pool) BRPop(timeout time.Duration, keys ...string) (key, value string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		key, value, err = g.BRPop(timeout, keys...)
+		return
+	})
+	return
+}
+
+// Same as Godb.WaitKey on a pooled connection.
+func (p *Pool) WaitKey(key string, timeout time.Duration) error {
+	return p.with(func(g *Godb) error { return g.WaitKey(key, timeout) })
+}
@@ -0,0 +1,34 @@
+package godb
+
+// Returns the server settings whose names match a glob pattern, e.g. "*" or "max*".
+func (g *Godb) ConfigGet(pattern string) (map[string]string, error) {
+	items, err := g.DoList("config get " + Quote(pattern))
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		settings[items[i]] = items[i+1]
+	}
+	return settings, nil
+}
+
+// Changes a server setting that can be tuned at runtime: loglevel, maxclients, maxvalue or save.
+// Returns ErrArgs for other settings and invalid values.
+func (g *Godb) ConfigSet(name, value string) error {
+	return g.exec("config set " + Quote(name) + " " + Quote(value))
+}
+
+// Same as Godb.ConfigGet on a pooled connection.
+func (p *Pool) ConfigGet(pattern string) (settings map[string]string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		settings, err = g.ConfigGet(pattern)
+		return
+	})
+	return
+}
+
+// Same as Godb.ConfigSet on a pooled connection.
+func (p *Pool) ConfigSet(name, value string) error {
+	return p.with(func(g *Godb) error { return g.ConfigSet(name, value) })
+}
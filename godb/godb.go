@@ -1,83 +1,604 @@
 package godb
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/marella/godb/wire"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const GODB_PORT = "2000"
 
+// Errors returned by the server.
+var (
+	ErrUnknownCommand = errors.New("godb: command not found")
+	ErrArgs           = errors.New("godb: insufficient or invalid arguments")
+	ErrKeyNotFound    = errors.New("godb: key not set")
+	ErrSyntax         = errors.New("godb: syntax error in query")
+	ErrNotNumber      = errors.New("godb: value is not a number or out of range")
+	ErrTooLarge       = errors.New("godb: query too large")
+	ErrLog            = errors.New("godb: server could not write to its log")
+	ErrWrongType      = errors.New("godb: key holds the wrong type of value")
+	ErrMaxClients     = errors.New("godb: server has too many clients")
+	ErrAuth           = errors.New("godb: not authenticated or wrong user name or password")
+	ErrDenied         = errors.New("godb: user may not run this command on these keys")
+
+	ErrTxState   = errors.New("godb: command not allowed in this transaction state")
+	ErrTxAborted = errors.New("godb: transaction aborted")
+
+	ErrPoolClosed = errors.New("godb: pool is closed")
+	ErrTimeout    = errors.New("godb: timed out waiting for a key")
+)
+
+// Maps the error codes sent by the server ("-C", "-A", ...) to errors.
+var codes = map[byte]error{
+	'C': ErrUnknownCommand,
+	'A': ErrArgs,
+	'K': ErrKeyNotFound,
+	'N': ErrNotNumber,
+	'S': ErrTooLarge,
+	'W': ErrLog,
+	'P': ErrSyntax,
+	'T': ErrTxState,
+	'X': ErrTxAborted,
+	'Y': ErrWrongType,
+	'L': ErrMaxClients,
+	'U': ErrAuth,
+	'D': ErrDenied,
+}
+
+// A ConnError is returned when the connection to the server fails or times out.
+// The query may or may not have been run by the server and the connection should be closed.
+type ConnError struct {
+	Op  string // "dial", "handshake", "write" or "read"
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return "godb: " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// A ServerError is an error code sent by the server that this client does not know.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return "godb: server error " + string(e)
+}
+
 type Godb struct {
+	// Largest response accepted from the server and largest query sent to it
+	MaxFrame int
+
 	conn net.Conn
 	db string
+	user string
+	opts options
+	broken bool // Set after a connection error
+
+	// Server-side state of the connection, as far as track can tell from the queries sent
+	tx         bool // A transaction was begun and not committed or rolled back
+	watching   bool // Keys are watched for the next transaction
+	subscribed bool // Channels, patterns or key prefixes were subscribed to
+	rebound    bool // A query other than Use or Auth may have switched the database or user
+}
+
+// Settings used by Dial.
+type options struct {
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxFrame     int
+	db           string
+	tls          *tls.Config
+	user         string
+	password     string
+}
+
+// An Option configures a connection made by Dial.
+type Option func(*options)
+
+// Limits the time taken to connect and complete the handshake. Zero means no limit
+// other than the deadline of the context passed to Dial.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) { o.dialTimeout = d }
+}
+
+// Limits the time to wait for each response. Zero means no limit.
+func WithReadTimeout(d time.Duration) Option {
+	return func(o *options) { o.readTimeout = d }
+}
+
+// Limits the time to send each query. Zero means no limit.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) { o.writeTimeout = d }
+}
+
+// Sets the largest query sent and response accepted. Defaults to wire.MAX_FRAME.
+func WithMaxFrame(n int) Option {
+	return func(o *options) { o.maxFrame = n }
+}
+
+// Connects over TLS. Unless config sets ServerName or InsecureSkipVerify, the server's
+// certificate is verified against the host name of the address. Servers started with
+// -tlsclientauth require also ask for a client certificate, set in config.Certificates.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) { o.tls = config }
+}
+
+// Authenticates as a user when connecting, as servers started with -users require.
+func WithAuth(user, password string) Option {
+	return func(o *options) { o.user, o.password = user, password }
+}
+
+// Selects a database by name when connecting. The server's default database is used otherwise.
+func WithDB(name string) Option {
+	return func(o *options) { o.db = name }
+}
+
+// Connects to the server at addr ("host" or "host:port", the port defaults to GODB_PORT).
+// Unlike New it returns an error instead of exiting when the server can't be reached.
+func Dial(ctx context.Context, addr string, opts ...Option) (*Godb, error) {
+	o := options{maxFrame: wire.MAX_FRAME}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, GODB_PORT)
+	}
+
+	if o.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &ConnError{"dial", err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if o.tls != nil {
+		config := o.tls
+		if config.ServerName == "" && !config.InsecureSkipVerify {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, &ConnError{"handshake", err}
+		}
+		conn = tlsConn
+	}
+	if err = wire.ClientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, &ConnError{"handshake", err}
+	}
+	g := &Godb{MaxFrame: o.maxFrame, conn: conn, opts: o}
+	if o.user != "" {
+		if err = g.Auth(o.user, o.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if o.db != "" {
+		if err = g.Use(o.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return g, nil
 }
 
+// Connects to the server at ip and exits the program if it can't be reached.
+//
+// Deprecated: Use Dial, which returns an error instead.
 func New(ip string, db string) *Godb {
-	conn, err := net.Dial("tcp", ip+":"+GODB_PORT)
+	g, err := Dial(context.Background(), ip, WithDB(db))
 	checkError(err)
-	//fmt.Fprintf(conn, db)
-	return &Godb{conn, db}
+	return g
+}
+
+// Closes the connection to the server.
+func (g *Godb) Close() error {
+	return g.conn.Close()
 }
 
 func (g *Godb) Query(s string) (r string, ok bool) {
 	r = "OK"
 	ok = false
-	BigWrite(g.conn, s)
-	s, Ok := BigRead(g.conn)
-	if !Ok {
+	s, err := g.roundTrip(s)
+	if err == ErrTooLarge {
+		r = "Error: Query too large"
 		return
 	}
-	code := s[0:1]
-	if code == "1" {
+	if err != nil || len(s) == 0 {
+		return
+	}
+	if s[0] == '1' {
+		return
+	}
+	r = format(s)
+	if s == "0" {
+		r = "NOT APPLIED"
+	}
+	ok = true
+	return
+}
+
+// Formats a response for display.
+func format(s string) (r string) {
+	r = "OK"
+	if len(s) == 0 {
 		return
-	} else if code == "-" {
+	}
+	code := s[0:1]
+	if code == "-" && len(s) > 1 {
 		r = "Error: "
 		switch s[1:2] {
 			case "C":
 				r += "Command not found"
+			case "D":
+				r += "Permission denied"
 			case "A":
 				r += "Insufficient Arguments"
 			case "K":
 				r += "Key not set"
+			case "L":
+				r += "Too many clients"
+			case "N":
+				r += "Value is not a number"
+			case "P":
+				r += "Syntax error"
+			case "S":
+				r += "Query too large"
+			case "T":
+				r += "Not allowed in this transaction state"
+			case "U":
+				r += "Authentication failed or required"
+			case "W":
+				r += "Could not write to the log"
+			case "X":
+				r += "Transaction aborted"
+			case "Y":
+				r += "Key holds the wrong type of value"
 		}
 	} else if code == "R" {
 		r = s[1:]
+	} else if code == "Q" {
+		r = "QUEUED"
+	} else if code == "L" {
+		items, _ := wire.DecodeList(s)
+		for i := range items {
+			items[i] = format(items[i])
+		}
+		r = strings.Join(items, "\n")
 	}
-	ok = true
 	return
 }
 
-func BigRead(conn net.Conn) (s string, ok bool) {
-	ok = false
-	s = ""
-	var buf [512]byte
-	n, err := conn.Read(buf[0:])
+// Runs a single command and returns its result, or "" for commands that return none.
+// Responses holding several values are returned undecoded, see DoList.
+// Errors sent by the server are returned as one of the Err* values or a ServerError,
+// and a broken connection as a *ConnError.
+func (g *Godb) Do(query string) (string, error) {
+	s, err := g.roundTrip(query)
+	if err != nil {
+		return "", err
+	}
+	return decode(s)
+}
+
+// Selects the database used by the following commands on this connection.
+// Database names may contain letters, digits, '_' and '-'.
+func (g *Godb) Use(name string) error {
+	rebound := g.rebound
+	err := g.exec("use " + Quote(name))
+	g.rebound = rebound
+	if err != nil {
+		return err
+	}
+	g.db = name
+	return nil
+}
+
+// Authenticates the connection as a user. Returns ErrAuth if the password is wrong.
+// Servers started with -users only run auth and quit before it succeeds.
+func (g *Godb) Auth(user, password string) error {
+	rebound := g.rebound
+	err := g.exec("auth " + Quote(user) + " " + Quote(password))
+	g.rebound = rebound
+	if err != nil {
+		return err
+	}
+	g.user = user
+	return nil
+}
+
+// Checks that the server is responding.
+func (g *Godb) Ping() error {
+	return g.exec("ping")
+}
+
+// Returns the value of a key or ErrKeyNotFound.
+func (g *Godb) Get(key string) (string, error) {
+	return g.Do(keysQuery("get", key))
+}
+
+// Sets the value of a key, removing any expiry.
+func (g *Godb) Set(key, value string) error {
+	return g.exec(setQuery(key, value))
+}
+
+// Deletes a key. Deleting a key which is not set is not an error.
+func (g *Godb) Del(key string) error {
+	return g.exec(keysQuery("del", key))
+}
+
+// Copies the value and expiry of src to dst.
+func (g *Godb) Copy(src, dst string) error {
+	return g.exec(keysQuery("copy", src, dst))
+}
+
+// Renames src to dst, overwriting dst if it is set.
+func (g *Godb) Rename(src, dst string) error {
+	return g.exec(keysQuery("rename", src, dst))
+}
+
+// Sets a key to expire after the given number of seconds.
+func (g *Godb) Expire(key string, seconds int) error {
+	return g.exec(expireQuery(key, seconds))
+}
+
+// Returns the seconds left before a key expires, or -1 if it has no expiry.
+func (g *Godb) TTL(key string) (int, error) {
+	s, err := g.Do(keysQuery("ttl", key))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	_, err = fmt.Sscan(s, &n)
+	return n, err
+}
+
+// Removes the expiry of a key.
+func (g *Godb) Persist(key string) error {
+	return g.exec(keysQuery("persist", key))
+}
+
+// Sets a key only if it is not set. Returns false if it was already set.
+func (g *Godb) SetNX(key, value string) (bool, error) {
+	return g.cond("setnx " + Quote(key) + " " + Quote(value))
+}
+
+// Same as SetNX, with the key expiring after the given number of seconds.
+// Useful as a lock or lease that is released if its holder goes away.
+func (g *Godb) SetNXEx(key, value string, seconds int) (bool, error) {
+	return g.cond(fmt.Sprintf("setnx %s %s ex %d", Quote(key), Quote(value), seconds))
+}
+
+// Sets a key only if it is already set. Returns false if it was not set.
+func (g *Godb) SetXX(key, value string) (bool, error) {
+	return g.cond("setxx " + Quote(key) + " " + Quote(value))
+}
+
+// Compare-and-swap: sets a key to new only if its current value is old.
+// Returns false if the key is not set or has another value.
+func (g *Godb) CAS(key, old, new string) (bool, error) {
+	return g.cond("cas " + Quote(key) + " " + Quote(old) + " " + Quote(new))
+}
+
+// Sets a key and returns its previous value. existed is false if the key was not set.
+func (g *Godb) GetSet(key, value string) (old string, existed bool, err error) {
+	s, err := g.roundTrip("getset " + Quote(key) + " " + Quote(value))
 	if err != nil {
 		return
 	}
-	size := int(buf[0])
-	s = string(buf[1:n])
-	for i := 0; i < size; i++ {
-		n, err = conn.Read(buf[0:])
-		if err != nil {
-			return
+	if s == "1" {
+		return "", false, nil
+	}
+	old, err = decode(s)
+	return old, err == nil, err
+}
+
+// Runs a conditional command, which responds "1" if it was applied and "0" if not.
+func (g *Godb) cond(query string) (bool, error) {
+	s, err := g.roundTrip(query)
+	if err != nil {
+		return false, err
+	}
+	switch s {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	}
+	_, err = decode(s)
+	if err == nil {
+		err = ServerError(s)
+	}
+	return false, err
+}
+
+// Adds 1 to the integer value of a key and returns the new value.
+// A key that is not set counts as 0. ErrNotNumber is returned if the value is not an integer.
+func (g *Godb) Incr(key string) (int64, error) {
+	return g.IncrBy(key, 1)
+}
+
+// Subtracts 1 from the integer value of a key and returns the new value.
+func (g *Godb) Decr(key string) (int64, error) {
+	return g.DecrBy(key, 1)
+}
+
+// Adds n to the integer value of a key and returns the new value.
+func (g *Godb) IncrBy(key string, n int64) (int64, error) {
+	return g.integer(fmt.Sprintf("incrby %s %d", Quote(key), n))
+}
+
+// Subtracts n from the integer value of a key and returns the new value.
+func (g *Godb) DecrBy(key string, n int64) (int64, error) {
+	return g.integer(fmt.Sprintf("decrby %s %d", Quote(key), n))
+}
+
+// Adds f to the numeric value of a key and returns the new value.
+func (g *Godb) IncrByFloat(key string, f float64) (float64, error) {
+	s, err := g.Do("incrbyfloat " + Quote(key) + " " + strconv.FormatFloat(f, 'g', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Runs a command that returns an integer.
+func (g *Godb) integer(query string) (int64, error) {
+	s, err := g.Do(query)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Runs a command that returns several values.
+func (g *Godb) DoList(query string) ([]string, error) {
+	s, err := g.Do(query)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := wire.DecodeList(s)
+	if !ok {
+		return nil, ServerError(s)
+	}
+	return items, nil
+}
+
+func (g *Godb) exec(query string) error {
+	_, err := g.Do(query)
+	return err
+}
+
+// Sends a query and returns the raw response.
+func (g *Godb) roundTrip(query string) (string, error) {
+	return g.exchange(query, g.opts.readTimeout)
+}
+
+// Same as roundTrip with the time to wait for the response. Zero means no limit.
+func (g *Godb) exchange(query string, readTimeout time.Duration) (string, error) {
+	if len(query) > g.MaxFrame {
+		return "", ErrTooLarge
+	}
+	g.track(query)
+	if g.opts.writeTimeout > 0 {
+		g.conn.SetWriteDeadline(time.Now().Add(g.opts.writeTimeout))
+	}
+	if err := wire.WriteFrame(g.conn, []byte(query)); err != nil {
+		g.broken = true
+		return "", &ConnError{"write", err}
+	}
+	if readTimeout > 0 {
+		g.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	} else if g.opts.readTimeout > 0 {
+		g.conn.SetReadDeadline(time.Time{})
+	}
+	buf, err := wire.ReadFrame(g.conn, g.MaxFrame)
+	if err != nil {
+		g.broken = true
+		return "", &ConnError{"read", err}
+	}
+	return string(buf), nil
+}
+
+// Records the server-side state a query leaves on the connection, so that Pool.Put can tell
+// whether the connection can be reused. Any command of a query may start a transaction, watch
+// keys, subscribe or switch the database or user, but only a query made of a single command ends them, as a query of several
+// commands may as well hold "commit" inside a quoted value.
+func (g *Godb) track(query string) {
+	cmds := strings.Split(query, ";")
+	for _, cmd := range cmds {
+		fields := strings.Fields(cmd)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "begin", "multi":
+			g.tx = true
+		case "watch":
+			g.watching = true
+		case "subscribe", "psubscribe", "watchkeys":
+			g.subscribed = true
+		case "use", "select", "auth":
+			g.rebound = true
+		case "commit", "exec", "rollback", "discard":
+			if len(cmds) == 1 && len(fields) == 1 {
+				g.tx, g.watching = false, false
+			}
+		case "unwatch":
+			if len(cmds) == 1 && len(fields) == 1 {
+				g.watching = false
+			}
 		}
-		s += string(buf[:n])
 	}
-	ok = true
-	return
 }
 
-func BigWrite(conn net.Conn, s string) bool {
-	size := len(s) + 1
-	s = string(size/512) + s
-	i := 0
-	for ;i < size/512; i++ {
-		conn.Write([]byte(s[i*512 : (i+1)*512]))
+// Decodes a response of a single command.
+func decode(s string) (string, error) {
+	if len(s) == 0 {
+		return "", ServerError(s)
+	}
+	switch s[0] {
+	case '1', '0', 'Q':
+		return "", nil
+	case 'R':
+		return s[1:], nil
+	case 'L':
+		return s, nil
+	case '-':
+		if len(s) > 1 {
+			if err, ok := codes[s[1]]; ok {
+				return "", err
+			}
+		}
+	}
+	return "", ServerError(s)
+}
+
+// Builds a query of a command that takes only keys.
+func keysQuery(cmd string, keys ...string) string {
+	q := cmd
+	for _, key := range keys {
+		q += " " + Quote(key)
+	}
+	return q
+}
+
+func setQuery(key, value string) string {
+	return "set " + Quote(key) + " " + Quote(value)
+}
+
+func expireQuery(key string, seconds int) string {
+	return fmt.Sprintf("expire %s %d", Quote(key), seconds)
+}
+
+// Quotes an argument so that the server reads it back exactly, whatever bytes it contains.
+// Arguments that are plain words are left as they are.
+func Quote(arg string) string {
+	if arg == "" || arg[0] == '$' || strings.ContainsAny(arg, " \t\r\n\v\f;\"'") {
+		return "$" + strconv.Itoa(len(arg)) + ":" + arg
 	}
-	conn.Write([]byte(s[i*512 : i*512 + size%512]))
-	return true
+	return arg
 }
 
 func checkError(err error) {
@@ -85,4 +606,4 @@ func checkError(err error) {
 		fmt.Fprintf(os.Stderr, "Fatal error: %s", err.Error())
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
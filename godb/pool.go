@@ -0,0 +1,338 @@
+package godb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Pool is a goroutine-safe client that keeps a set of connections to the server.
+// Each command checks out a connection, runs on it and returns it to the pool.
+// Connections that break are closed and replaced by new ones on a later checkout.
+type Pool struct {
+	// Largest number of idle connections kept for reuse.
+	MaxIdle int
+
+	// Largest number of connections open at once, including those in use.
+	// Checkouts wait for a connection to be returned once the limit is reached. Zero means no limit.
+	MaxOpen int
+
+	// Idle connections that have not been used for this long are pinged before being handed out.
+	// Zero pings on every checkout.
+	CheckAfter time.Duration
+
+	addr string
+	opts []Option
+
+	mu     sync.Mutex
+	idle   []*pooled
+	sem    chan struct{} // Holds a token for every open connection if MaxOpen > 0
+	stats  PoolStats
+	closed bool
+}
+
+// Statistics of a Pool.
+type PoolStats struct {
+	Open  int // Connections currently open
+	InUse int // Connections currently checked out
+	Idle  int // Connections waiting in the pool
+
+	Dials        int64         // Connections opened
+	DialErrors   int64         // Failed attempts to open a connection
+	Broken       int64         // Connections closed after a connection error
+	CheckFailed  int64         // Idle connections closed because a ping failed
+	WaitCount    int64         // Checkouts that had to wait for MaxOpen
+	WaitDuration time.Duration // Total time spent waiting for MaxOpen
+}
+
+type pooled struct {
+	g        *Godb
+	lastUsed time.Time
+}
+
+// Creates a pool of connections to addr. Connections are made with Dial and the given options
+// when they are first needed.
+func NewPool(addr string, maxIdle, maxOpen int, opts ...Option) *Pool {
+	p := &Pool{
+		MaxIdle:    maxIdle,
+		MaxOpen:    maxOpen,
+		CheckAfter: time.Second,
+		addr:       addr,
+		opts:       opts,
+	}
+	if maxOpen > 0 {
+		p.sem = make(chan struct{}, maxOpen)
+	}
+	return p
+}
+
+// Checks out a connection, waiting for one to be returned if MaxOpen connections are in use.
+// The connection must be given back with Put.
+func (p *Pool) Conn(ctx context.Context) (*Godb, error) {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			start := time.Now()
+			select {
+			case p.sem <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			p.mu.Lock()
+			p.stats.WaitCount++
+			p.stats.WaitDuration += time.Since(start)
+			p.mu.Unlock()
+		}
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.release()
+			return nil, ErrPoolClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.stats.Idle--
+		p.stats.InUse++
+		p.mu.Unlock()
+
+		if time.Since(c.lastUsed) < p.CheckAfter {
+			return c.g, nil
+		}
+		if err := c.g.Ping(); err == nil {
+			return c.g, nil
+		}
+		c.g.Close()
+		p.mu.Lock()
+		p.stats.InUse--
+		p.stats.Open--
+		p.stats.CheckFailed++
+		p.mu.Unlock()
+	}
+
+	g, err := Dial(ctx, p.addr, p.opts...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.DialErrors++
+		p.release()
+		return nil, err
+	}
+	p.stats.Dials++
+	p.stats.Open++
+	p.stats.InUse++
+	return g, nil
+}
+
+// Returns a connection checked out with Conn to the pool.
+// Broken connections, connections switched to another database or user, connections left
+// in a transaction, watching keys or subscribed, and connections beyond MaxIdle are closed.
+func (p *Pool) Put(g *Godb) {
+	p.mu.Lock()
+	p.stats.InUse--
+	if g.broken || !g.reusable() || p.closed || len(p.idle) >= p.MaxIdle {
+		if g.broken {
+			p.stats.Broken++
+		}
+		p.stats.Open--
+		p.mu.Unlock()
+		g.Close()
+		p.release()
+		return
+	}
+	p.idle = append(p.idle, &pooled{g, time.Now()})
+	p.stats.Idle++
+	p.mu.Unlock()
+	p.release()
+}
+
+// Reports whether the server-side state of a connection is still as Dial left it.
+func (g *Godb) reusable() bool {
+	return g.db == g.opts.db && g.user == g.opts.user && !g.rebound && !g.tx && !g.watching && !g.subscribed
+}
+
+// Gives back the MaxOpen token of a connection.
+func (p *Pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// Returns the current statistics of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Closes all idle connections. Connections in use are closed when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.stats.Open -= len(idle)
+	p.stats.Idle = 0
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.g.Close()
+	}
+	return nil
+}
+
+// Runs f on a pooled connection.
+func (p *Pool) with(f func(g *Godb) error) error {
+	g, err := p.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer p.Put(g)
+	return f(g)
+}
+
+// Same as Godb.Do on a pooled connection.
+func (p *Pool) Do(query string) (r string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		r, err = g.Do(query)
+		return
+	})
+	return
+}
+
+// Same as Godb.Get on a pooled connection.
+func (p *Pool) Get(key string) (v string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.Get(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.Set on a pooled connection.
+func (p *Pool) Set(key, value string) error {
+	return p.with(func(g *Godb) error { return g.Set(key, value) })
+}
+
+// Same as Godb.Del on a pooled connection.
+func (p *Pool) Del(key string) error {
+	return p.with(func(g *Godb) error { return g.Del(key) })
+}
+
+// Same as Godb.Copy on a pooled connection.
+func (p *Pool) Copy(src, dst string) error {
+	return p.with(func(g *Godb) error { return g.Copy(src, dst) })
+}
+
+// Same as Godb.Rename on a pooled connection.
+func (p *Pool) Rename(src, dst string) error {
+	return p.with(func(g *Godb) error { return g.Rename(src, dst) })
+}
+
+// Same as Godb.Expire on a pooled connection.
+func (p *Pool) Expire(key string, seconds int) error {
+	return p.with(func(g *Godb) error { return g.Expire(key, seconds) })
+}
+
+// Same as Godb.TTL on a pooled connection.
+func (p *Pool) TTL(key string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.TTL(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.Persist on a pooled connection.
+func (p *Pool) Persist(key string) error {
+	return p.with(func(g *Godb) error { return g.Persist(key) })
+}
+
+// Same as Godb.Incr on a pooled connection.
+func (p *Pool) Incr(key string) (int64, error) {
+	return p.IncrBy(key, 1)
+}
+
+// Same as Godb.Decr on a pooled connection.
+func (p *Pool) Decr(key string) (int64, error) {
+	return p.DecrBy(key, 1)
+}
+
+// Same as Godb.IncrBy on a pooled connection.
+func (p *Pool) IncrBy(key string, n int64) (v int64, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.IncrBy(key, n)
+		return
+	})
+	return
+}
+
+// Same as Godb.DecrBy on a pooled connection.
+func (p *Pool) DecrBy(key string, n int64) (v int64, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.DecrBy(key, n)
+		return
+	})
+	return
+}
+
+// Same as Godb.IncrByFloat on a pooled connection.
+func (p *Pool) IncrByFloat(key string, f float64) (v float64, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.IncrByFloat(key, f)
+		return
+	})
+	return
+}
+
+// Same as Godb.SetNX on a pooled connection.
+func (p *Pool) SetNX(key, value string) (ok bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		ok, err = g.SetNX(key, value)
+		return
+	})
+	return
+}
+
+// Same as Godb.SetNXEx on a pooled connection.
+func (p *Pool) SetNXEx(key, value string, seconds int) (ok bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		ok, err = g.SetNXEx(key, value, seconds)
+		return
+	})
+	return
+}
+
+// Same as Godb.SetXX on a pooled connection.
+func (p *Pool) SetXX(key, value string) (ok bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		ok, err = g.SetXX(key, value)
+		return
+	})
+	return
+}
+
+// Same as Godb.CAS on a pooled connection.
+func (p *Pool) CAS(key, old, new string) (ok bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		ok, err = g.CAS(key, old, new)
+		return
+	})
+	return
+}
+
+// Same as Godb.GetSet on a pooled connection.
+func (p *Pool) GetSet(key, value string) (old string, existed bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		old, existed, err = g.GetSet(key, value)
+		return
+	})
+	return
+}
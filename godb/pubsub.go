@@ -0,0 +1,257 @@
+package godb
+
+import (
+	"context"
+	"github.com/marella/godb/wire"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of received messages buffered in Subscription.C and Subscription.Events.
+const MESSAGE_BUFFER = 100
+
+// A message published on a channel.
+type Message struct {
+	Channel string
+	Payload string
+	Pattern string // Pattern the channel matched if received through PSubscribe
+}
+
+// A change to a key, sent to connections watching keys.
+type Event struct {
+	// Name of the command that changed the key ("set", "del", "hset", ...) with a few exceptions:
+	// "incrby" for incr, decr and decrby, "set" for setnx, setxx, cas and getset,
+	// "rename_from" and "rename_to" for the source and destination of rename, "copy_to" for
+	// the destination of copy and "expired" for a key deleted after its deadline.
+	Type  string
+	Key   string
+	Value string // New value of a key holding a string, "" otherwise
+}
+
+// A Subscription is a connection that receives the messages published on the channels and
+// patterns it subscribes to, and the changes to the keys it watches. It is safe for concurrent use.
+//
+// Messages and events must be read promptly: the server disconnects subscribers that fall far
+// behind, after which C and Events are closed and Err returns the connection error.
+type Subscription struct {
+	C      <-chan Message // Closed when the subscription is closed or its connection fails
+	Events <-chan Event   // Same
+
+	g       *Godb
+	c       chan Message
+	events  chan Event
+	mu      sync.Mutex  // Allows one command at a time
+	replies chan string // Responses to commands, read from the connection with the messages
+	done    chan struct{}
+	closing chan struct{}
+	close   sync.Once
+	err     error // Set before done is closed
+}
+
+// Opens a connection for receiving published messages. Subscribe to channels or patterns
+// with the methods of the Subscription.
+func DialSubscription(ctx context.Context, addr string, opts ...Option) (*Subscription, error) {
+	g, err := Dial(ctx, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan Message, MESSAGE_BUFFER)
+	events := make(chan Event, MESSAGE_BUFFER)
+	s := &Subscription{
+		C:       c,
+		Events:  events,
+		g:       g,
+		c:       c,
+		events:  events,
+		replies: make(chan string, 1),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go s.read()
+	return s, nil
+}
+
+// Subscribes to channels. Returns the number of channels and patterns subscribed to.
+func (s *Subscription) Subscribe(channels ...string) (int, error) {
+	return s.command("subscribe", channels)
+}
+
+// Subscribes to the channels matching glob patterns (see Godb.Keys for the syntax).
+func (s *Subscription) PSubscribe(patterns ...string) (int, error) {
+	return s.command("psubscribe", patterns)
+}
+
+// Unsubscribes from channels, or from all channels if none are given.
+func (s *Subscription) Unsubscribe(channels ...string) (int, error) {
+	return s.command("unsubscribe", channels)
+}
+
+// Unsubscribes from patterns, or from all patterns if none are given.
+func (s *Subscription) PUnsubscribe(patterns ...string) (int, error) {
+	return s.command("punsubscribe", patterns)
+}
+
+// Watches the keys starting with prefixes in the database of the connection (see WithDB),
+// sending their changes to Events.
+func (s *Subscription) WatchKeys(prefixes ...string) (int, error) {
+	return s.command("watchkeys", prefixes)
+}
+
+// Stops watching key prefixes, or all of them if none are given.
+func (s *Subscription) UnwatchKeys(prefixes ...string) (int, error) {
+	return s.command("unwatchkeys", prefixes)
+}
+
+// Returns the error that closed C, or nil if it is open or was closed with Close.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Closes the connection and C.
+func (s *Subscription) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.closing)
+		err = s.g.Close()
+		<-s.done
+	})
+	return err
+}
+
+func (s *Subscription) command(cmd string, names []string) (int, error) {
+	q := keysQuery(cmd, names...)
+	if len(q) > s.g.MaxFrame {
+		return 0, ErrTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.g.opts.writeTimeout > 0 {
+		s.g.conn.SetWriteDeadline(time.Now().Add(s.g.opts.writeTimeout))
+	}
+	if err := wire.WriteFrame(s.g.conn, []byte(q)); err != nil {
+		s.g.conn.Close()
+		return 0, &ConnError{"write", err}
+	}
+	select {
+	case r := <-s.replies:
+		v, err := decode(r)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(v)
+	case <-s.done:
+		return 0, s.err
+	}
+}
+
+// Reads messages and responses until the connection is closed.
+func (s *Subscription) read() {
+	defer close(s.done)
+	defer close(s.c)
+	defer close(s.events)
+	for {
+		buf, err := wire.ReadFrame(s.g.conn, s.g.MaxFrame)
+		if err != nil {
+			select {
+			case <-s.closing:
+			default:
+				s.err = &ConnError{"read", err}
+			}
+			return
+		}
+		frame := string(buf)
+		if !strings.HasPrefix(frame, "M") {
+			s.replies <- frame
+			continue
+		}
+		items, ok := wire.DecodeList("L" + frame[1:])
+		if !ok || len(items) == 0 {
+			continue
+		}
+		var msg Message
+		switch {
+		case items[0] == "message" && len(items) == 3:
+			msg = Message{Channel: items[1], Payload: items[2]}
+		case items[0] == "pmessage" && len(items) == 4:
+			msg = Message{Pattern: items[1], Channel: items[2], Payload: items[3]}
+		case items[0] == "event" && len(items) == 4:
+			select {
+			case s.events <- Event{items[1], items[2], items[3]}:
+			case <-s.closing:
+				return
+			}
+			continue
+		default:
+			continue
+		}
+		select {
+		case s.c <- msg:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// Publishes a message on a channel and returns the number of subscriptions it was sent to.
+func (g *Godb) Publish(channel, message string) (int, error) {
+	n, err := g.integer("publish " + Quote(channel) + " " + Quote(message))
+	return int(n), err
+}
+
+// Same as Godb.Publish on a pooled connection.
+func (p *Pool) Publish(channel, message string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.Publish(channel, message)
+		return
+	})
+	return
+}
+
+// Opens a Subscription to the pool's server, with the pool's options, and subscribes to channels.
+// The connection is not part of the pool.
+func (p *Pool) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	s, err := DialSubscription(ctx, p.addr, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.Subscribe(channels...); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Watches the keys starting with prefix on the server at addr, in the database selected by
+// WithDB. Their changes are sent to the returned channel until ctx is done or the connection
+// fails, then the channel is closed.
+// Unlike Godb.Watch, which is for transactions, this opens a connection of its own.
+func Watch(ctx context.Context, addr string, prefix string, opts ...Option) (<-chan Event, error) {
+	s, err := DialSubscription(ctx, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.WatchKeys(prefix); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
+		}
+		s.Close()
+	}()
+	return s.Events, nil
+}
+
+// Same as the Watch function, with the pool's server and options.
+func (p *Pool) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, p.addr, prefix, p.opts...)
+}
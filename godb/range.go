@@ -0,0 +1,83 @@
+package godb
+
+import "strconv"
+
+// A key and its value.
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// Returns the keys in [start, end) with their values, in ascending order. An empty end means
+// no upper bound. At most limit pairs are returned unless limit is 0.
+func (g *Godb) Range(start, end string, limit int) ([]Pair, error) {
+	return g.pairs("range " + Quote(start) + " " + Quote(end) + " " + strconv.Itoa(limit))
+}
+
+// Same as Range but in descending order, starting from the last key before end.
+func (g *Godb) RevRange(start, end string, limit int) ([]Pair, error) {
+	return g.pairs("revrange " + Quote(start) + " " + Quote(end) + " " + strconv.Itoa(limit))
+}
+
+// Returns the keys starting with prefix with their values, in ascending order.
+// At most limit pairs are returned unless limit is 0.
+func (g *Godb) Prefix(prefix string, limit int) ([]Pair, error) {
+	return g.pairs("prefix " + Quote(prefix) + " " + strconv.Itoa(limit))
+}
+
+// Same as Prefix but in descending order.
+func (g *Godb) RevPrefix(prefix string, limit int) ([]Pair, error) {
+	return g.pairs("revprefix " + Quote(prefix) + " " + strconv.Itoa(limit))
+}
+
+// Runs a command that returns keys alternating with their values.
+func (g *Godb) pairs(query string) ([]Pair, error) {
+	items, err := g.DoList(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%2 != 0 {
+		return nil, ServerError("odd number of items in a list of pairs")
+	}
+	pairs := make([]Pair, len(items)/2)
+	for i := range pairs {
+		pairs[i] = Pair{items[2*i], items[2*i+1]}
+	}
+	return pairs, nil
+}
+
+// Same as Godb.Range on a pooled connection.
+func (p *Pool) Range(start, end string, limit int) (pairs []Pair, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		pairs, err = g.Range(start, end, limit)
+		return
+	})
+	return
+}
+
+// Same as Godb.RevRange on a pooled connection.
+func (p *Pool) RevRange(start, end string, limit int) (pairs []Pair, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		pairs, err = g.RevRange(start, end, limit)
+		return
+	})
+	return
+}
+
+// Same as Godb.Prefix on a pooled connection.
+func (p *Pool) Prefix(prefix string, limit int) (pairs []Pair, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		pairs, err = g.Prefix(prefix, limit)
+		return
+	})
+	return
+}
+
+// Same as Godb.RevPrefix on a pooled connection.
+func (p *Pool) RevPrefix(prefix string, limit int) (pairs []Pair, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		pairs, err = g.RevPrefix(prefix, limit)
+		return
+	})
+	return
+}
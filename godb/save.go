@@ -0,0 +1,48 @@
+package godb
+
+import "time"
+
+// Writes a snapshot of the current database and returns once it is on disk.
+// Writers are not blocked meanwhile.
+func (g *Godb) Save() error {
+	return g.exec("save")
+}
+
+// Starts writing a snapshot of the current database in the background. Returns false if
+// a snapshot is already being written.
+func (g *Godb) BGSave() (bool, error) {
+	return g.cond("bgsave")
+}
+
+// Returns when the last snapshot of the current database was written, or when the server
+// opened it if none was since.
+func (g *Godb) LastSave() (time.Time, error) {
+	n, err := g.integer("lastsave")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(n, 0), nil
+}
+
+// Same as Godb.Save on a pooled connection.
+func (p *Pool) Save() error {
+	return p.with(func(g *Godb) error { return g.Save() })
+}
+
+// Same as Godb.BGSave on a pooled connection.
+func (p *Pool) BGSave() (started bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		started, err = g.BGSave()
+		return
+	})
+	return
+}
+
+// Same as Godb.LastSave on a pooled connection.
+func (p *Pool) LastSave() (t time.Time, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		t, err = g.LastSave()
+		return
+	})
+	return
+}
@@ -0,0 +1,130 @@
+package godb
+
+import "strconv"
+
+// Returns the keys matching a glob pattern, sorted. Patterns may use *, ?, [abc], [a-z],
+// [^a] and \ to escape one of these.
+// The whole key space is traversed, prefer Scan on large databases.
+func (g *Godb) Keys(pattern string) ([]string, error) {
+	return g.DoList("keys " + Quote(pattern))
+}
+
+// Returns how many of the keys are set.
+func (g *Godb) Exists(keys ...string) (int, error) {
+	q := keysQuery("exists", keys...)
+	n, err := g.integer(q)
+	return int(n), err
+}
+
+// Returns the number of keys in the database.
+func (g *Godb) DBSize() (int, error) {
+	n, err := g.integer("dbsize")
+	return int(n), err
+}
+
+// Returns an iterator over the keys matching a glob pattern (see Keys). Each round trip
+// examines about count keys; if count is 0 the server's default is used.
+// Every key that is set for the whole iteration is returned once. Keys written meanwhile
+// may or may not be returned.
+//
+//	it := g.Scan("user:*", 100)
+//	for it.Next() {
+//		fmt.Println(it.Key())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (g *Godb) Scan(pattern string, count int) *Iterator {
+	return &Iterator{do: g.DoList, pattern: pattern, count: count, cursor: "0"}
+}
+
+// An Iterator steps through the keys returned by a scan, fetching them in batches.
+type Iterator struct {
+	do      func(query string) ([]string, error)
+	pattern string
+	count   int
+	cursor  string // Cursor of the next batch, "0" once the last batch was fetched
+	started bool
+	keys    []string
+	key     string
+	err     error
+}
+
+// Advances to the next key, fetching a batch if needed. Returns false when there are no
+// more keys or an error occurred.
+func (it *Iterator) Next() bool {
+	for len(it.keys) == 0 {
+		if it.err != nil || (it.started && it.cursor == "0") {
+			return false
+		}
+		it.fetch()
+	}
+	it.key, it.keys = it.keys[0], it.keys[1:]
+	return true
+}
+
+// Returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) fetch() {
+	q := "scan " + Quote(it.cursor) + " match " + Quote(it.pattern)
+	if it.count > 0 {
+		q += " count " + strconv.Itoa(it.count)
+	}
+	items, err := it.do(q)
+	if err == nil && len(items) == 0 {
+		err = ServerError("scan returned no cursor")
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.started = true
+	it.cursor, it.keys = items[0], items[1:]
+}
+
+// Same as Godb.Keys on a pooled connection.
+func (p *Pool) Keys(pattern string) (keys []string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		keys, err = g.Keys(pattern)
+		return
+	})
+	return
+}
+
+// Same as Godb.Exists on a pooled connection.
+func (p *Pool) Exists(keys ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.Exists(keys...)
+		return
+	})
+	return
+}
+
+// Same as Godb.DBSize on a pooled connection.
+func (p *Pool) DBSize() (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.DBSize()
+		return
+	})
+	return
+}
+
+// Same as Godb.Scan, fetching each batch on a pooled connection.
+func (p *Pool) Scan(pattern string, count int) *Iterator {
+	do := func(query string) (items []string, err error) {
+		err = p.with(func(g *Godb) (err error) {
+			items, err = g.DoList(query)
+			return
+		})
+		return
+	}
+	return &Iterator{do: do, pattern: pattern, count: count, cursor: "0"}
+}
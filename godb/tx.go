@@ -0,0 +1,97 @@
+package godb
+
+// A Tx queues commands on a connection between Begin and Commit.
+// The server runs them all at once at Commit, without interleaving commands of other
+// clients, and rolls them all back if one of them fails.
+type Tx struct {
+	g *Godb
+}
+
+// Watches keys for the next transaction on this connection. Its Commit returns
+// ErrTxAborted if any of the keys has been changed by then.
+func (g *Godb) Watch(keys ...string) error {
+	return g.exec(keysQuery("watch", keys...))
+}
+
+// Forgets the keys watched on this connection.
+func (g *Godb) Unwatch() error {
+	return g.exec("unwatch")
+}
+
+// Starts a transaction. Until it is committed or rolled back the connection can only be
+// used through the Tx.
+func (g *Godb) Begin() (*Tx, error) {
+	if err := g.exec("begin"); err != nil {
+		return nil, err
+	}
+	return &Tx{g}, nil
+}
+
+// Queues a command of the transaction.
+func (tx *Tx) Do(query string) error {
+	s, err := tx.g.roundTrip(query)
+	if err != nil {
+		return err
+	}
+	if s != "Q" {
+		if _, err = decode(s); err == nil {
+			err = ServerError(s)
+		}
+	}
+	return err
+}
+
+// Queues a get. Its value is returned by Commit.
+func (tx *Tx) Get(key string) error {
+	return tx.Do(keysQuery("get", key))
+}
+
+// Queues a set.
+func (tx *Tx) Set(key, value string) error {
+	return tx.Do(setQuery(key, value))
+}
+
+// Queues a del.
+func (tx *Tx) Del(key string) error {
+	return tx.Do(keysQuery("del", key))
+}
+
+// Queues a copy.
+func (tx *Tx) Copy(src, dst string) error {
+	return tx.Do(keysQuery("copy", src, dst))
+}
+
+// Queues a rename.
+func (tx *Tx) Rename(src, dst string) error {
+	return tx.Do(keysQuery("rename", src, dst))
+}
+
+// Queues an expire.
+func (tx *Tx) Expire(key string, seconds int) error {
+	return tx.Do(expireQuery(key, seconds))
+}
+
+// Runs the queued commands and returns their values, with "" for commands that return none
+// and for gets of keys that are not set.
+// ErrTxAborted is returned if a watched key changed or a command could not be queued.
+// If a command fails, none of the commands take effect and its error is returned.
+func (tx *Tx) Commit() ([]string, error) {
+	items, err := tx.g.DoList("commit")
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if items[i], err = decode(item); err == ErrKeyNotFound {
+			items[i], err = "", nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Discards the queued commands.
+func (tx *Tx) Rollback() error {
+	return tx.g.exec("rollback")
+}
@@ -0,0 +1,222 @@
+package godb
+
+import "strconv"
+
+// Returns the type of the value of a key: "string", "hash", "list" or "set", or "none" if
+// the key is not set.
+// Commands on a key holding another type of value than they work on fail with ErrWrongType.
+func (g *Godb) Type(key string) (string, error) {
+	return g.Do("type " + Quote(key))
+}
+
+// Sets a field of a hash, creating the hash if needed. Reports whether the field is new.
+func (g *Godb) HSet(key, field, value string) (bool, error) {
+	n, err := g.integer("hset " + Quote(key) + " " + Quote(field) + " " + Quote(value))
+	return n == 1, err
+}
+
+// Returns the value of a field of a hash, or ErrKeyNotFound if the key or the field is not set.
+func (g *Godb) HGet(key, field string) (string, error) {
+	return g.Do("hget " + Quote(key) + " " + Quote(field))
+}
+
+// Deletes fields of a hash and returns how many were set.
+func (g *Godb) HDel(key string, fields ...string) (int, error) {
+	return g.count("hdel", key, fields)
+}
+
+// Returns all fields of a hash with their values.
+func (g *Godb) HGetAll(key string) (map[string]string, error) {
+	items, err := g.DoList("hgetall " + Quote(key))
+	if err != nil {
+		return nil, err
+	}
+	h := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		h[items[i]] = items[i+1]
+	}
+	return h, nil
+}
+
+// Adds values to the head of a list, creating the list if needed, and returns its length.
+// The values end up in reverse order.
+func (g *Godb) LPush(key string, values ...string) (int, error) {
+	return g.count("lpush", key, values)
+}
+
+// Adds values to the tail of a list, creating the list if needed, and returns its length.
+func (g *Godb) RPush(key string, values ...string) (int, error) {
+	return g.count("rpush", key, values)
+}
+
+// Removes and returns the first value of a list, or ErrKeyNotFound if the list is empty.
+func (g *Godb) LPop(key string) (string, error) {
+	return g.Do("lpop " + Quote(key))
+}
+
+// Removes and returns the last value of a list, or ErrKeyNotFound if the list is empty.
+func (g *Godb) RPop(key string) (string, error) {
+	return g.Do("rpop " + Quote(key))
+}
+
+// Returns the values of a list from start to stop inclusive. Negative indexes count from
+// the end, -1 being the last value.
+func (g *Godb) LRange(key string, start, stop int) ([]string, error) {
+	return g.DoList("lrange " + Quote(key) + " " + strconv.Itoa(start) + " " + strconv.Itoa(stop))
+}
+
+// Adds members to a set, creating the set if needed, and returns how many were new.
+func (g *Godb) SAdd(key string, members ...string) (int, error) {
+	return g.count("sadd", key, members)
+}
+
+// Removes members from a set and returns how many were in it.
+func (g *Godb) SRem(key string, members ...string) (int, error) {
+	return g.count("srem", key, members)
+}
+
+// Returns the members of a set, sorted.
+func (g *Godb) SMembers(key string) ([]string, error) {
+	return g.DoList("smembers " + Quote(key))
+}
+
+// Reports whether a value is a member of a set.
+func (g *Godb) SIsMember(key, member string) (bool, error) {
+	return g.cond("sismember " + Quote(key) + " " + Quote(member))
+}
+
+// Runs a command taking a key and several values that returns a count.
+func (g *Godb) count(cmd string, key string, values []string) (int, error) {
+	if len(values) == 0 {
+		return 0, ErrArgs
+	}
+	q := keysQuery(cmd, append([]string{key}, values...)...)
+	n, err := g.integer(q)
+	return int(n), err
+}
+
+// Same as Godb.Type on a pooled connection.
+func (p *Pool) Type(key string) (t string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		t, err = g.Type(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.HSet on a pooled connection.
+func (p *Pool) HSet(key, field, value string) (added bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		added, err = g.HSet(key, field, value)
+		return
+	})
+	return
+}
+
+// Same as Godb.HGet on a pooled connection.
+func (p *Pool) HGet(key, field string) (v string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.HGet(key, field)
+		return
+	})
+	return
+}
+
+// Same as Godb.HDel on a pooled connection.
+func (p *Pool) HDel(key string, fields ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.HDel(key, fields...)
+		return
+	})
+	return
+}
+
+// Same as Godb.HGetAll on a pooled connection.
+func (p *Pool) HGetAll(key string) (h map[string]string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		h, err = g.HGetAll(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.LPush on a pooled connection.
+func (p *Pool) LPush(key string, values ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.LPush(key, values...)
+		return
+	})
+	return
+}
+
+// Same as Godb.RPush on a pooled connection.
+func (p *Pool) RPush(key string, values ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.RPush(key, values...)
+		return
+	})
+	return
+}
+
+// Same as Godb.LPop on a pooled connection.
+func (p *Pool) LPop(key string) (v string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.LPop(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.RPop on a pooled connection.
+func (p *Pool) RPop(key string) (v string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		v, err = g.RPop(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.LRange on a pooled connection.
+func (p *Pool) LRange(key string, start, stop int) (values []string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		values, err = g.LRange(key, start, stop)
+		return
+	})
+	return
+}
+
+// Same as Godb.SAdd on a pooled connection.
+func (p *Pool) SAdd(key string, members ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.SAdd(key, members...)
+		return
+	})
+	return
+}
+
+// Same as Godb.SRem on a pooled connection.
+func (p *Pool) SRem(key string, members ...string) (n int, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		n, err = g.SRem(key, members...)
+		return
+	})
+	return
+}
+
+// Same as Godb.SMembers on a pooled connection.
+func (p *Pool) SMembers(key string) (members []string, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		members, err = g.SMembers(key)
+		return
+	})
+	return
+}
+
+// Same as Godb.SIsMember on a pooled connection.
+func (p *Pool) SIsMember(key, member string) (ok bool, err error) {
+	err = p.with(func(g *Godb) (err error) {
+		ok, err = g.SIsMember(key, member)
+		return
+	})
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+var errSyntax = errors.New("syntax error")
+
+// Splits a query into commands and their arguments.
+//
+// Commands are separated by ';' and arguments by whitespace. An argument can be written as
+//
+//	word            a run of characters other than whitespace, ';' and quotes
+//	"text"          with the escapes \" \\ \' \n \r \t \0 and \xHH
+//	'text'          taken literally, except for the escapes \' and \\
+//	$<n>:<bytes>    exactly n bytes taken as they are, so any value can be sent
+//
+// Adjacent words and quoted strings form a single argument, e.g. ab"c d" is "abc d".
+func Lex(sql string) (cmds [][]string, err error) {
+	var args []string
+	var word []byte
+	inWord := false // An argument is being read, possibly empty like ""
+
+	endWord := func() {
+		if inWord {
+			args = append(args, string(word))
+			word = word[:0]
+			inWord = false
+		}
+	}
+	endCmd := func() {
+		endWord()
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+			args = nil
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ';':
+			endCmd()
+			i++
+
+		case isSpace(c):
+			endWord()
+			i++
+
+		case c == '"' || c == '\'':
+			inWord = true
+			if word, i, err = lexQuoted(sql, i, word); err != nil {
+				return nil, err
+			}
+
+		case c == '$' && !inWord:
+			n, j, ok := binaryPrefix(sql[i:])
+			if !ok {
+				word = append(word, c)
+				inWord = true
+				i++
+				break
+			}
+			i += j
+			if n > len(sql)-i {
+				return nil, errSyntax
+			}
+			word = append(word, sql[i:i+n]...)
+			inWord = true
+			i += n
+			if i < len(sql) && !isSpace(sql[i]) && sql[i] != ';' {
+				return nil, errSyntax
+			}
+
+		default:
+			word = append(word, c)
+			inWord = true
+			i++
+		}
+	}
+	endCmd()
+	return
+}
+
+// Reads a quoted string starting at sql[i] and appends its contents to word.
+// Returns the index after the closing quote.
+func lexQuoted(sql string, i int, word []byte) ([]byte, int, error) {
+	quote := sql[i]
+	for i++; i < len(sql); i++ {
+		c := sql[i]
+		if c == quote {
+			return word, i + 1, nil
+		}
+		if c != '\\' {
+			word = append(word, c)
+			continue
+		}
+		if i++; i >= len(sql) {
+			break
+		}
+		c = sql[i]
+		if quote == '\'' {
+			if c != '\'' && c != '\\' {
+				word = append(word, '\\')
+			}
+			word = append(word, c)
+			continue
+		}
+		switch c {
+		case '"', '\\', '\'':
+			word = append(word, c)
+		case 'n':
+			word = append(word, '\n')
+		case 'r':
+			word = append(word, '\r')
+		case 't':
+			word = append(word, '\t')
+		case '0':
+			word = append(word, 0)
+		case 'x':
+			if i+2 >= len(sql) {
+				return nil, 0, errSyntax
+			}
+			b, err := strconv.ParseUint(sql[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, 0, errSyntax
+			}
+			word = append(word, byte(b))
+			i += 2
+		default:
+			return nil, 0, errSyntax
+		}
+	}
+	return nil, 0, errSyntax // unterminated
+}
+
+// Parses the "$<n>:" prefix of a binary argument. j is the length of the prefix.
+func binaryPrefix(s string) (n int, j int, ok bool) {
+	j = 1
+	for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+		j++
+	}
+	if j == 1 || j >= len(s) || s[j] != ':' || j > 11 {
+		return 0, 0, false
+	}
+	n, err := strconv.Atoi(s[1:j])
+	if err != nil {
+		return 0, 0, false
+	}
+	return n, j + 1, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
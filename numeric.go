@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// Adds delta to the integer value of a key and returns the response with the new value.
+// A key that is not set counts as 0. The expiry of the key is kept.
+// The caller must hold the write lock of the shard of the key.
+func (d *DB) incrBy(key string, delta int64) string {
+	var n int64
+	v, ok := d.lookup(key)
+	if ok {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "-N"
+		}
+	} else {
+		d.clearDeadline(key) // of an expired key
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return "-N"
+	}
+	n += delta
+	v = strconv.FormatInt(n, 10)
+	d.store(key, v)
+	return "R" + v
+}
+
+// Same as incrBy for the delta given as an argument, negated if negate is set.
+func (d *DB) incrByArg(key string, arg string, negate bool) string {
+	delta, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || (negate && delta == math.MinInt64) {
+		return "-N"
+	}
+	if negate {
+		delta = -delta
+	}
+	return d.incrBy(key, delta)
+}
+
+// Adds a floating point delta to the value of a key and returns the response with the new value.
+func (d *DB) incrByFloat(key string, arg string) string {
+	delta, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return "-N"
+	}
+	var f float64
+	v, ok := d.lookup(key)
+	if ok {
+		if f, err = strconv.ParseFloat(v, 64); err != nil {
+			return "-N"
+		}
+	} else {
+		d.clearDeadline(key)
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "-N"
+	}
+	v = strconv.FormatFloat(f, 'f', -1, 64)
+	d.store(key, v)
+	return "R" + v
+}
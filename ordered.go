@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/marella/godb/wire"
+	"sort"
+	"strconv"
+)
+
+// A key and its value, as returned by range queries.
+type pair struct {
+	key, value string
+}
+
+// Returns the keys in [start, end) with their values, in ascending order or in descending
+// order if reverse is set. An empty end means no upper bound. At most limit pairs are returned
+// unless limit is 0. Keys holding hashes, lists or sets are skipped.
+// Like scan, shards are read locked one at a time: the result is not a consistent view of
+// keys written while the query runs.
+func (d *DB) rangePairs(start, end string, limit int, reverse bool) []pair {
+	var pairs []pair
+	for _, s := range d.shards {
+		s.mu.RLock()
+		t := now()
+		n, found := s.index.seek(start), 0
+		if reverse {
+			n = s.index.seekBefore(end)
+		}
+		for n != nil && (limit == 0 || found < limit) {
+			if n.key < start || (end != "" && n.key >= end) {
+				break
+			}
+			if v, ok := s.data[n.key]; ok && !s.expiredAt(n.key, t) {
+				pairs = append(pairs, pair{n.key, v})
+				found++
+			}
+			if reverse {
+				n = n.prev
+			} else {
+				n = n.next[0]
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return (pairs[i].key < pairs[j].key) != reverse
+	})
+	if limit > 0 && len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+	return pairs
+}
+
+// Returns the smallest key greater than every key starting with prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// Runs range, revrange, prefix and revprefix:
+//
+//	range <start> <end> [limit]
+//	prefix <prefix> [limit]
+//
+// The response lists each key followed by its value.
+func (d *DB) rangeCommand(cmd string, args []string) string {
+	var start, end string
+	if cmd == "range" || cmd == "revrange" {
+		start, end, args = args[1], args[2], args[3:]
+	} else {
+		start, end, args = args[1], prefixEnd(args[1]), args[2:]
+	}
+	limit := 0
+	if len(args) > 1 {
+		return "-A"
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "-A"
+		}
+		limit = n
+	}
+	pairs := d.rangePairs(start, end, limit, cmd == "revrange" || cmd == "revprefix")
+	items := make([]string, 0, 2*len(pairs))
+	for _, p := range pairs {
+		items = append(items, p.key, p.value)
+	}
+	return wire.EncodeList(items)
+}
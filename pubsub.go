@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of messages queued for a subscriber. A subscriber that falls this far behind is
+// disconnected rather than slowing down publishers.
+const PUBSUB_QUEUE = 1024
+
+// Commands of the publish/subscribe system. Channels are independent of databases and keys.
+var pubsubCommands = map[string]bool{
+	"psubscribe":   true,
+	"publish":      true,
+	"punsubscribe": true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"unwatchkeys":  true,
+	"watchkeys":    true,
+}
+
+// Subscribers of each channel and each pattern.
+var (
+	channels = make(map[string]map[*subscriber]bool)
+	patterns = make(map[string]map[*subscriber]bool)
+	pubsubMu sync.RWMutex // To protect the maps above and the subscriptions of every subscriber
+)
+
+// A subscriber holds the subscriptions of a session and delivers its messages from a goroutine
+// of its own, so that publishers never wait for a client.
+type subscriber struct {
+	channels map[string]bool
+	patterns map[string]bool
+	prefixes map[keyPrefix]bool // Key prefixes watched with watchkeys
+	queue    chan []string      // Messages, see push
+	kill     func()             // Closes the connection of the session
+	killed   sync.Once
+}
+
+// Runs subscribe, unsubscribe, psubscribe, punsubscribe, publish, watchkeys and unwatchkeys:
+//
+//	subscribe <channel> [<channel> ...]      ->  number of subscriptions of the session
+//	unsubscribe [<channel> ...]              ->  same, all channels if none are given
+//	psubscribe <pattern> [<pattern> ...]     ->  same, for channels matching glob patterns
+//	punsubscribe [<pattern> ...]
+//	publish <channel> <message>              ->  number of subscriptions the message was sent to
+//	watchkeys <prefix> [<prefix> ...]        ->  number of subscriptions, see notify
+//	unwatchkeys [<prefix> ...]               ->  same, all prefixes of the database if none are given
+//
+// Messages are sent to the client with the push function of the session, and kill closes its
+// connection if it falls PUBSUB_QUEUE messages behind. Sessions without push can publish but not subscribe.
+// A message is one of
+//
+//	message <channel> <payload>
+//	pmessage <pattern> <channel> <payload>
+//	event <type> <key> <value>
+func (s *Session) pubsubCommand(cmd string, args []string) string {
+	if cmd == "publish" {
+		return fmt.Sprint("R", publish(args[1], strings.Join(args[2:], " ")))
+	}
+	if s.push == nil {
+		return "-C"
+	}
+	if s.sub == nil {
+		s.sub = &subscriber{
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			prefixes: make(map[keyPrefix]bool),
+			queue:    make(chan []string, PUBSUB_QUEUE),
+			kill:     s.kill,
+		}
+		go s.sub.deliver(s.push)
+	}
+
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+	sub := s.sub
+	switch cmd {
+	case "subscribe":
+		for _, ch := range args[1:] {
+			sub.channels[ch] = true
+			addSubscriber(channels, ch, sub)
+		}
+	case "psubscribe":
+		for _, p := range args[1:] {
+			sub.patterns[p] = true
+			addSubscriber(patterns, p, sub)
+		}
+	case "unsubscribe":
+		for _, ch := range namesOr(args[1:], sub.channels) {
+			delete(sub.channels, ch)
+			removeSubscriber(channels, ch, sub)
+		}
+	case "punsubscribe":
+		for _, p := range namesOr(args[1:], sub.patterns) {
+			delete(sub.patterns, p)
+			removeSubscriber(patterns, p, sub)
+		}
+	case "watchkeys":
+		for _, p := range args[1:] {
+			sub.watchKeys(keyPrefix{s.db, p})
+		}
+	case "unwatchkeys":
+		for _, p := range sub.watched(s.db, args[1:]) {
+			sub.unwatchKeys(keyPrefix{s.db, p})
+		}
+	}
+	return fmt.Sprint("R", len(sub.channels)+len(sub.patterns)+len(sub.prefixes))
+}
+
+// Returns names, or all the names in the set if there are none.
+func namesOr(names []string, set map[string]bool) []string {
+	if len(names) > 0 {
+		return names
+	}
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func addSubscriber(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	if subs[name] == nil {
+		subs[name] = make(map[*subscriber]bool)
+	}
+	subs[name][sub] = true
+}
+
+func removeSubscriber(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	delete(subs[name], sub)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+}
+
+// Removes all subscriptions of the session and stops delivering its messages.
+func (s *Session) unsubscribeAll() {
+	if s.sub == nil {
+		return
+	}
+	pubsubMu.Lock()
+	for ch := range s.sub.channels {
+		removeSubscriber(channels, ch, s.sub)
+	}
+	for p := range s.sub.patterns {
+		removeSubscriber(patterns, p, s.sub)
+	}
+	for kp := range s.sub.prefixes {
+		s.sub.unwatchKeys(kp)
+	}
+	close(s.sub.queue)
+	pubsubMu.Unlock()
+	s.sub = nil
+}
+
+// Sends a message to the subscribers of a channel and of the patterns matching it.
+// Returns the number of subscriptions it was sent to.
+func publish(channel, message string) int {
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+	n := 0
+	for sub := range channels[channel] {
+		sub.send([]string{"message", channel, message})
+		n++
+	}
+	for p, subs := range patterns {
+		if !match(p, channel) {
+			continue
+		}
+		for sub := range subs {
+			sub.send([]string{"pmessage", p, channel, message})
+			n++
+		}
+	}
+	return n
+}
+
+// Queues a message. Requires pubsubMu to be held so that the queue can't be closed meanwhile.
+func (sub *subscriber) send(msg []string) {
+	select {
+	case sub.queue <- msg:
+	default:
+		sub.killed.Do(sub.kill)
+	}
+}
+
+// Writes queued messages to the client until the queue is closed.
+// If a write fails the connection is closed and the remaining messages are dropped.
+func (sub *subscriber) deliver(push func(msg []string) error) {
+	for msg := range sub.queue {
+		if err := push(msg); err != nil {
+			sub.killed.Do(sub.kill)
+			break
+		}
+	}
+	for range sub.queue {
+	}
+}
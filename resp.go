@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/marella/godb/wire"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Largest number of arguments accepted in a single RESP command.
+const RESP_MAX_ARGS = 1 << 20
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// Commands whose "1" and "R" responses are sent to RESP clients as integers.
+// All other successful commands reply with +OK or a bulk string.
+var respInteger = map[string]bool{
+	"cas":       true,
+	"copy":      true,
+	"dbsize":    true,
+	"decr":      true,
+	"decrby":    true,
+	"del":       true,
+	"exists":    true,
+	"expire":    true,
+	"hdel":      true,
+	"hset":      true,
+	"incr":      true,
+	"incrby":    true,
+	"lastsave":  true,
+	"lpush":     true,
+	"persist":   true,
+	"publish":   true,
+	"rpush":     true,
+	"sadd":      true,
+	"setnx":     true,
+	"sismember": true,
+	"srem":      true,
+	"ttl":       true,
+	"waitkey":   true,
+}
+
+// Accepts connections speaking RESP2 (the Redis protocol) on addr, so that redis-cli and
+// Redis client libraries can run commands against the same db map as godb clients.
+func serveRESP(addr string) {
+	listener, err := listen(addr)
+	checkError(err)
+	serve(listener, handleRESPClient, func(conn net.Conn) {
+		io.WriteString(conn, "-ERR max number of clients reached\r\n")
+	})
+}
+
+func handleRESPClient(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var mu sync.Mutex // To protect w, used for replies and published messages
+
+	s := NewSession()
+	s.push = func(msg []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteString(respArray(msg))
+		return w.Flush()
+	}
+	s.kill = func() { conn.Close() }
+	defer s.Close()
+
+	// requests are read by another goroutine so that a client disconnecting is noticed
+	// while a command waits, as in handleClient
+	type request struct {
+		args []string
+		more bool  // Whether more pipelined requests are already buffered
+		err  error // errRESPProtocol
+	}
+	requests := make(chan request)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			args, err := readRESP(r)
+			if err != nil && err != errRESPProtocol {
+				close(closed)
+				return
+			}
+			select {
+			case requests <- request{args, r.Buffered() > 0, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	s.closed = closed
+
+	for {
+		var req request
+		select {
+		case req = <-requests:
+		case <-closed:
+			return
+		}
+		if req.err != nil {
+			mu.Lock()
+			fmt.Fprintf(w, "-ERR %s\r\n", req.err.Error())
+			w.Flush()
+			mu.Unlock()
+			return
+		}
+		if len(req.args) == 0 {
+			continue
+		}
+		reply, ok := s.respCommand(req.args)
+		mu.Lock()
+		w.WriteString(reply)
+		// pipelined commands are answered together
+		var err error
+		if !req.more || !ok {
+			err = w.Flush()
+		}
+		mu.Unlock()
+		if err != nil || !ok {
+			return
+		}
+	}
+}
+
+// Runs a command and encodes the reply. ok is false if the connection should be closed.
+func (s *Session) respCommand(args []string) (reply string, ok bool) {
+	cmd := strings.ToLower(args[0])
+	switch cmd {
+	case "ping":
+		if len(args) > 1 {
+			// echoing data is only for authenticated clients, as in Redis
+			if response := s.authorize(cmd, args); response != APPLIED {
+				return respError(cmd, response), true
+			}
+			return respBulk(args[1]), true
+		}
+		return "+PONG\r\n", true
+
+	case "quit":
+		return "+OK\r\n", false
+
+	case "select":
+		// Redis databases are numbered, godb databases are named
+		args[0] = "use"
+		if len(args) > 1 && args[1] == "0" {
+			args[1] = DEFAULT_DB
+		}
+
+	case "set":
+		// Redis takes options instead of the values of several words of GoSQL
+		if _, ok := respSet(args); !ok {
+			if s.tx != nil {
+				s.tx.failed = true
+			}
+			return "-ERR syntax error\r\n", true
+		}
+		response, _ := s.runCommand(args, respSet)
+		return respReply(cmd, response), true
+
+	case "del":
+		// Redis accepts several keys
+		if len(args) < 2 {
+			return respError(cmd, "-A"), true
+		}
+		if s.tx != nil && len(args) > 2 {
+			return "-ERR DEL of several keys is not supported in MULTI\r\n", true
+		}
+		n := 0
+		for _, key := range args[1:] {
+			switch response, _ := s.RunCommand([]string{args[0], key}); response {
+			case APPLIED:
+				n++
+			case NOT_APPLIED:
+				// the key was not set
+			case "Q":
+				return respReply(cmd, response), true
+			default:
+				return respError(cmd, response), true
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n), true
+
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "watchkeys", "unwatchkeys":
+		// Redis replies once for every channel or pattern
+		names := args[1:]
+		if len(names) == 0 && s.sub != nil {
+			switch cmd {
+			case "unsubscribe":
+				names = namesOr(nil, s.sub.channels)
+			case "punsubscribe":
+				names = namesOr(nil, s.sub.patterns)
+			case "unwatchkeys":
+				names = s.sub.watched(s.db, nil)
+			}
+		}
+		if len(names) == 0 {
+			response, _ := s.RunCommand(args)
+			if strings.HasPrefix(response, "-") {
+				return respError(cmd, response), true
+			}
+			return "*3\r\n" + respBulk(cmd) + "$-1\r\n:0\r\n", true
+		}
+		for _, name := range names {
+			response, _ := s.RunCommand([]string{cmd, name})
+			if strings.HasPrefix(response, "-") {
+				return reply + respError(cmd, response), true
+			}
+			reply += "*3\r\n" + respBulk(cmd) + respBulk(name) + ":" + response[1:] + "\r\n"
+		}
+		return reply, true
+	}
+
+	var names []string // Commands answered by exec, as the client named them
+	if (cmd == "exec" || cmd == "commit") && s.tx != nil {
+		for _, q := range s.tx.queue {
+			names = append(names, strings.ToLower(q.args[0]))
+		}
+	}
+
+	response, _ := s.RunCommand(args)
+	if cmd == "type" && strings.HasPrefix(response, "R") {
+		return "+" + response[1:] + "\r\n", true
+	}
+	if strings.HasPrefix(response, "L") {
+		items, _ := wire.DecodeList(response)
+		switch cmd {
+		case "scan":
+			// the cursor followed by the keys
+			return "*2\r\n" + respBulk(items[0]) + respArray(items[1:]), true
+		case "exec", "commit":
+			reply = fmt.Sprintf("*%d\r\n", len(items))
+			for i, item := range items {
+				reply += respReply(names[i], item)
+			}
+			return reply, true
+		}
+		return respArray(items), true
+	}
+	return respReply(cmd, response), true
+}
+
+// Translates SET <key> <value> [NX|XX] [EX <seconds>|PX <milliseconds>|KEEPTTL] into set, setnx
+// or setxx with the arguments written by normalize. ok is false if an option is malformed.
+func respSet(args []string) (out []string, ok bool) {
+	if len(args) < 3 {
+		// rejected by the argc check
+		return args, true
+	}
+	cmd := "set"
+	var expiry []string
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case (opt == "nx" || opt == "xx") && cmd == "set":
+			cmd += opt
+		case (opt == "ex" || opt == "px") && expiry == nil && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return nil, false
+			}
+			if opt == "ex" {
+				n *= 1000
+			}
+			expiry = []string{"pxat", strconv.FormatInt(now()+n, 10)}
+			i++
+		case opt == "keepttl" && expiry == nil:
+			expiry = []string{"keepttl"}
+		default:
+			return nil, false
+		}
+	}
+	return append([]string{cmd, args[1], args[2]}, expiry...), true
+}
+
+// Translates the response of a GoSQL command into a RESP reply.
+func respReply(cmd string, response string) string {
+	switch {
+	case strings.HasPrefix(response, "-"):
+		return respError(cmd, response)
+	case response == "Q":
+		return "+QUEUED\r\n"
+	case response == NOT_APPLIED:
+		if respInteger[cmd] {
+			return ":0\r\n"
+		}
+		if blockingCommands[cmd] {
+			// timed out
+			return "*-1\r\n"
+		}
+		return "$-1\r\n"
+	case cmd == "getset" && response == APPLIED:
+		// there was no previous value
+		return "$-1\r\n"
+	case strings.HasPrefix(response, "R"):
+		if respInteger[cmd] {
+			return ":" + response[1:] + "\r\n"
+		}
+		return respBulk(response[1:])
+	case respInteger[cmd]:
+		return ":1\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// Encodes strings as an array of bulk strings.
+func respArray(items []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += respBulk(item)
+	}
+	return reply
+}
+
+// Translates a GoSQL error code into a RESP reply.
+func respError(cmd string, code string) string {
+	switch code {
+	case "-C":
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+	case "-A":
+		return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", cmd)
+	case "-K":
+		switch cmd {
+		case "get", "hget", "lpop", "rpop":
+			return "$-1\r\n"
+		case "ttl":
+			return ":-2\r\n"
+		}
+		if respInteger[cmd] {
+			return ":0\r\n"
+		}
+		return "-ERR no such key\r\n"
+	case "-N":
+		return "-ERR value is not a number or out of range\r\n"
+	case "-S":
+		return "-ERR value too large\r\n"
+	case "-T":
+		return fmt.Sprintf("-ERR '%s' is not allowed in this transaction state\r\n", cmd)
+	case "-X":
+		// the transaction was aborted
+		return "*-1\r\n"
+	case "-W":
+		return "-ERR could not write to the log\r\n"
+	case "-Y":
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	case "-U":
+		if cmd == "auth" {
+			return "-WRONGPASS invalid username-password pair\r\n"
+		}
+		return "-NOAUTH Authentication required.\r\n"
+	case "-D":
+		return fmt.Sprintf("-NOPERM this user has no permissions to run the '%s' command or its keys\r\n", cmd)
+	}
+	return "-ERR " + code + "\r\n"
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// Reads a command, either as an array of bulk strings or as an inline command.
+// Commands whose arguments add up to more than the maxframe setting are rejected.
+func readRESP(r *bufio.Reader) (args []string, err error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, errRESPProtocol
+	}
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err = readRESPLine(r)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > frameLimit()-total {
+			return nil, errRESPProtocol
+		}
+		total += size
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, errRESPProtocol
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return
+}
+
+// Reads a line without its line ending. Lines longer than the maxframe setting are rejected.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > frameLimit()+2 {
+			return "", errRESPProtocol
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default number of keys examined by a scan.
+const SCAN_COUNT = 10
+
+// Commands that lock shards one at a time themselves instead of locking the shards of their
+// keys for the whole command. They can't be used in transactions.
+var selfLocking = map[string]bool{
+	"dbsize":    true,
+	"keys":      true,
+	"prefix":    true,
+	"range":     true,
+	"revprefix": true,
+	"revrange":  true,
+	"scan":      true,
+}
+
+// Returns the keys matching a glob pattern, sorted, whatever the types of their values.
+// Shards are read locked one at a time, so writers are only blocked for one shard.
+func (d *DB) keys(pattern string) []string {
+	var keys []string
+	for _, s := range d.shards {
+		s.mu.RLock()
+		t := now()
+		for n := s.index.head.next[0]; n != nil; n = n.next[0] {
+			if !s.expiredAt(n.key, t) && match(pattern, n.key) {
+				keys = append(keys, n.key)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the number of keys in the database.
+func (d *DB) size() int {
+	n := 0
+	for _, s := range d.shards {
+		s.mu.RLock()
+		t := now()
+		n += len(s.data) + len(s.objects)
+		for key := range s.expires {
+			if s.expiredAt(key, t) {
+				n--
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Reports whether a key in the shard is past its deadline. The shard must be locked.
+func (s *shard) expiredAt(key string, t int64) bool {
+	deadline, ok := s.expires[key]
+	return ok && deadline <= t
+}
+
+// Examines about count keys starting at cursor and returns those matching pattern along
+// with the cursor to continue from. The scan starts and ends with the cursor "0".
+//
+// Shards are visited in order and the keys of a shard in sorted order; the cursor holds the
+// shard and the last key examined. Every key that is set for the whole scan is returned once.
+// Keys written during the scan may or may not be returned.
+func (d *DB) scan(cursor string, pattern string, count int) (next string, keys []string, ok bool) {
+	i, after, hasAfter, ok := parseCursor(cursor)
+	if !ok {
+		return
+	}
+	examined := 0
+	for ; i < len(d.shards); i, hasAfter = i+1, false {
+		s := d.shards[i]
+		s.mu.RLock()
+		t := now()
+		n := s.index.head.next[0]
+		if hasAfter {
+			if n = s.index.seek(after); n != nil && n.key == after {
+				n = n.next[0]
+			}
+		}
+		for ; n != nil; n = n.next[0] {
+			key := n.key
+			if !s.expiredAt(key, t) && match(pattern, key) {
+				keys = append(keys, key)
+			}
+			if examined++; examined >= count {
+				s.mu.RUnlock()
+				return fmt.Sprintf("%d-%x", i, key), keys, true
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return "0", keys, true
+}
+
+// Parses a cursor: "0", "<shard>" or "<shard>-<hex of the last key examined>".
+func parseCursor(cursor string) (shard int, after string, hasAfter bool, ok bool) {
+	num, key := cursor, ""
+	if j := strings.Index(cursor, "-"); j >= 0 {
+		num, key, hasAfter = cursor[:j], cursor[j+1:], true
+	}
+	shard, err := strconv.Atoi(num)
+	if err != nil || shard < 0 || shard >= SHARDS {
+		return
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return
+	}
+	return shard, string(b), hasAfter, true
+}
+
+// Parses the arguments of scan: <cursor> [match <pattern>] [count <n>].
+func scanArgs(args []string) (cursor string, pattern string, count int, ok bool) {
+	cursor, pattern, count = args[1], "*", SCAN_COUNT
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return
+			}
+			count = n
+		default:
+			return
+		}
+	}
+	ok = true
+	return
+}
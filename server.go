@@ -1,78 +1,392 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"bufio"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"github.com/marella/godb/wire"
+	"io"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
-const GODB_PORT = "2000"
+const (
+	GODB_PORT = "2000"
 
-var db map[string]string
+	DB_FILE  = "db.txt" // Snapshot of the default database
+	WAL_FILE = "db.wal" // Commands applied to the default database since the last snapshot
 
-var mutex = &sync.Mutex{}
+	HANDSHAKE_TIMEOUT = 5 * time.Second
+
+	// Sent to clients that still use the old BigRead/BigWrite framing.
+	LEGACY_ERROR = "-V: unsupported protocol, please upgrade the godb client"
+)
 
 var argc = map[string]int {
+	"bgsave": 0,
+	"blpop": 2,
+	"brpop": 2,
+	"auth": 2,
+	"cas": 3,
+	"config": 2,
 	"copy": 2,
+	"decr": 1,
+	"decrby": 2,
+	"dbsize": 0,
 	"del": 1,
+	"exists": 1,
+	"expire": 2,
 	"get": 1,
+	"getset": 2,
+	"hdel": 2,
+	"hget": 2,
+	"hgetall": 1,
+	"hset": 3,
+	"incr": 1,
+	"incrby": 2,
+	"incrbyfloat": 2,
+	"keys": 1,
+	"lastsave": 0,
+	"lpop": 1,
+	"lpush": 2,
+	"lrange": 3,
+	"persist": 1,
+	"prefix": 1,
+	"psubscribe": 1,
+	"publish": 2,
+	"punsubscribe": 0,
+	"ping": 0,
 	"quit": 0,
+	"range": 2,
 	"rename": 2,
+	"revprefix": 1,
+	"revrange": 2,
+	"rpop": 1,
+	"rpush": 2,
+	"sadd": 2,
+	"save": 0,
+	"scan": 1,
 	"set": 2,
+	"setnx": 2,
+	"setxx": 2,
+	"shutdown": 0,
+	"sismember": 2,
+	"smembers": 1,
+	"srem": 2,
+	"subscribe": 1,
+	"ttl": 1,
+	"type": 1,
+	"unsubscribe": 0,
+	"unwatchkeys": 0,
+	"use": 1,
+	"waitkey": 2,
+	"watchkeys": 1,
+
+	// transactions
+	"begin": 0,
+	"commit": 0,
+	"discard": 0,
+	"exec": 0,
+	"multi": 0,
+	"rollback": 0,
+	"unwatch": 0,
+	"watch": 1,
+}
+
+// Commands that modify the db map and are recorded in the write-ahead log.
+var mutating = map[string]bool{
+	"cas":         true,
+	"copy":        true,
+	"decr":        true,
+	"decrby":      true,
+	"del":         true,
+	"expire":      true,
+	"getset":      true,
+	"hdel":        true,
+	"hset":        true,
+	"incr":        true,
+	"incrby":      true,
+	"incrbyfloat": true,
+	"lpop":        true,
+	"lpush":       true,
+	"persist":     true,
+	"pexpireat":   true, // expire as rewritten by normalize, e.g. in transactions
+	"rename":      true,
+	"rpop":        true,
+	"rpush":       true,
+	"sadd":        true,
+	"set":         true,
+	"setnx":       true,
+	"setxx":       true,
+	"srem":        true,
 }
 
-func GoSQL(sql string) (response string, status bool) {
+// State of a client connection.
+type Session struct {
+	db      *DB     // Database selected with use
+	tx      *Tx     // Transaction being queued, if any
+	watches []watch // Keys watched for the next transaction
+
+	push   func(msg []string) error // Sends a message published on a subscribed channel, if the connection can
+	kill   func()                   // Closes the connection
+	sub    *subscriber              // Subscriptions, once the session subscribed to a channel
+	closed <-chan struct{}          // Closed when the client disconnects, if the connection can tell
+
+	user *user // Set by auth
+}
+
+// Creates a session using the default database.
+func NewSession() *Session {
+	d, _ := openDB(DEFAULT_DB) // opened in main
+	return &Session{db: d}
+}
+
+// Releases the watches and subscriptions of the session when its connection is closed.
+func (s *Session) Close() {
+	s.tx = nil
+	s.unwatch()
+	s.unsubscribeAll()
+}
+
+// Runs a query holding a single command. See Lex for the syntax.
+func (s *Session) GoSQL(sql string) (response string, status bool) {
+	cmds, err := Lex(sql)
+	if err != nil || len(cmds) > 1 {
+		return "-P", true
+	}
+	if len(cmds) == 0 {
+		return "-C", true
+	}
+	return s.RunCommand(cmds[0])
+}
+
+// Runs a command that is already split into its arguments.
+// Used by GoSQL and the RESP listener.
+func (s *Session) RunCommand(args []string) (response string, status bool) {
+	return s.runCommand(args, normalize)
+}
+
+// Same as RunCommand, with the arguments rewritten by norm instead of normalize.
+func (s *Session) runCommand(args []string, norm func([]string) ([]string, bool)) (response string, status bool) {
 	response = "1"
 	status = true
 
-	sql = strings.Trim(sql, "; ")
-	
-	// find the command word
-	cmd := sql
-	if i := strings.Index(sql, " "); i > 0 {
-		cmd = sql[0:i]
+	if len(args) == 0 {
+		response = "-C"
+		return
+	}
+	cmd := strings.ToLower(args[0]) // to support upper and lower case commands
+
+	// sessions can't find out anything about commands they may not run
+	if response = s.authorize(cmd, args); response != APPLIED {
+		if s.tx != nil {
+			s.tx.failed = true
+		}
+		return
 	}
-	cmd = strings.ToLower(cmd) // to support upper and lower case commands
-	
+
 	// check if command is present and parameters count is matching
-	args := strings.Fields(sql)
 	if v, ok := argc[cmd]; !ok {
 		response = "-C"
-		return
 	} else if len(args)-1 < v {
 		response = "-A"
+	} else if mutating[cmd] && tooLarge(args[1:]) {
+		response = "-S"
+	}
+	if response != "1" {
+		if s.tx != nil {
+			s.tx.failed = true
+		}
+		return
+	}
+
+	if txCommands[cmd] {
+		response = s.txCommand(cmd, args)
+		return
+	}
+
+	if cmd == "shutdown" || cmd == "config" || cmd == "auth" || saveCommands[cmd] {
+		if s.tx != nil {
+			s.tx.failed = true
+			response = "-T"
+			return
+		}
+		if cmd == "config" {
+			response = configCommand(args)
+			return
+		}
+		if cmd == "auth" {
+			response = s.auth(args)
+			return
+		}
+		if saveCommands[cmd] {
+			response = s.saveCommand(cmd)
+			return
+		}
+		nosave := len(args) > 1 && strings.ToLower(args[1]) == "nosave"
+		if len(args) > 2 || (len(args) == 2 && !nosave && strings.ToLower(args[1]) != "save") {
+			response = "-A"
+			return
+		}
+		go shutdown(!nosave)
+		status = false // the server closes the connection anyway
+		return
+	}
+
+	if pubsubCommands[cmd] || blockingCommands[cmd] {
+		if s.tx != nil {
+			s.tx.failed = true
+			response = "-T"
+			return
+		}
+		if blockingCommands[cmd] {
+			response = s.blockingCommand(cmd, args)
+		} else {
+			response = s.pubsubCommand(cmd, args)
+		}
+		return
+	}
+
+	if cmd == "use" && s.tx == nil {
+		// watches belong to the database they were made on
+		s.unwatch()
+		d, err := openDB(args[1])
+		if err == errDBName {
+			response = "-A"
+		} else if err != nil {
+			logf(LOG_ERROR, "Could not open database %s: %s\n", args[1], err.Error())
+			response = "-W"
+		} else {
+			s.db = d
+		}
+		return
+	}
+
+	normalized, ok := norm(args)
+	if !ok {
+		response = "-A"
+		if s.tx != nil {
+			s.tx.failed = true
+		}
 		return
 	}
 
+	if s.tx != nil {
+		response = s.queue(cmd, args, norm)
+		return
+	}
+	args = normalized
+
 	// run the query
-	mutex.Lock()
+	d := s.db
+	unlock := d.lock(commandKeys(cmd, args), mutating[cmd])
+	defer unlock()
+	if mutating[cmd] && d.wal != nil {
+		if err := d.wal.Append(stamp(args)); err != nil {
+			logf(LOG_ERROR, "WAL: %s\n", err.Error())
+			response = "-W"
+			return
+		}
+	}
+	response, status = d.execute(args)
+	d.written(args, response)
+	return
+}
+
+// Applies a command to the database. The caller must hold the locks of the shards of its keys.
+// Used by GoSQL and while replaying the write-ahead log.
+func (d *DB) execute(args []string) (response string, status bool) {
+	response = "1"
+	status = true
+
+	cmd := strings.ToLower(args[0])
+	if t, ok := commandTypes[cmd]; ok {
+		if kind := d.typeOf(args[1]); kind != TYPE_NONE && kind != t {
+			response = "-Y"
+			return
+		}
+	}
 	switch cmd {
 
 		case "copy":
 			if args[1] == args[2] {
 				break
 			}
-			if v, ok := db[args[1]]; ok {
-				db[args[2]] = v
+			if v, ok := d.value(args[1]); ok {
+				d.storeValue(args[2], cloneObject(v))
+				d.clearDeadline(args[2])
+				if t, ok := d.deadline(args[1]); ok {
+					d.setDeadline(args[2], t)
+				}
 			} else {
-				response = "-A"
+				response = "-K"
 			}
 
 		case "del":
-			delete(db, args[1])
+			if !d.exists(args[1]) {
+				response = NOT_APPLIED
+			}
+			d.remove(args[1])
 
 		case "get":
-			if v, ok := db[args[1]]; ok {
+			if v, ok := d.lookup(args[1]); ok {
 				response = fmt.Sprint("R", v)
 			} else {
 				response = "-K"
 			}
 
+		case "exists":
+			n := 0
+			for _, key := range args[1:] {
+				if d.exists(key) {
+					n++
+				}
+			}
+			response = fmt.Sprint("R", n)
+
+		case "dbsize":
+			response = fmt.Sprint("R", d.size())
+
+		case "keys":
+			response = wire.EncodeList(d.keys(args[1]))
+
+		case "scan":
+			cursor, pattern, count, ok := scanArgs(args)
+			if !ok {
+				response = "-A"
+				break
+			}
+			next, keys, ok := d.scan(cursor, pattern, count)
+			if !ok {
+				response = "-A"
+				break
+			}
+			response = wire.EncodeList(append([]string{next}, keys...))
+
+		case "range", "revrange", "prefix", "revprefix":
+			response = d.rangeCommand(cmd, args)
+
+		case "incr":
+			response = d.incrBy(args[1], 1)
+
+		case "decr":
+			response = d.incrBy(args[1], -1)
+
+		case "incrby":
+			response = d.incrByArg(args[1], args[2], false)
+
+		case "decrby":
+			response = d.incrByArg(args[1], args[2], true)
+
+		case "incrbyfloat":
+			response = d.incrByFloat(args[1], args[2])
+
+		case "ping":
+			response = "RPONG"
+
 		case "quit":
 			status = false // to break the loop
 
@@ -80,139 +394,237 @@ func GoSQL(sql string) (response string, status bool) {
 			if args[1] == args[2] {
 				break
 			}
-			if v, ok := db[args[1]]; ok {
-				db[args[2]] = v
-				delete(db, args[1])
+			if v, ok := d.value(args[1]); ok {
+				t, expires := d.deadline(args[1])
+				d.remove(args[1])
+				d.storeValue(args[2], v)
+				d.clearDeadline(args[2])
+				if expires {
+					d.setDeadline(args[2], t)
+				}
 			} else {
 				response = "-K"
 			}
 
 		case "set":
-			db[args[1]] = strings.Join(args[2:], " ")
+			d.set(args[1], args[2:])
 
-		default:
-			response = "-C"
+		case "setnx":
+			response = d.setIf(args[1], false, args[2:])
 
-	}
-	mutex.Unlock()
-	return
-}
+		case "setxx":
+			response = d.setIf(args[1], true, args[2:])
 
-func LoadDB() {
-	buf, err := ioutil.ReadFile("db.txt")
-	if err != nil {
-		return
-	}
-	b := bytes.NewBuffer(buf)
-	d := gob.NewDecoder(b)
+		case "cas":
+			response = d.cas(args[1], args[2], args[3:])
 
-    // Decoding the serialized data
-    err = d.Decode(&db)
-    if err != nil {
-        //panic(err)
-        return
-    }
-}
+		case "getset":
+			response = d.getSet(args[1], args[2])
+
+		case "pexpireat":
+			if d.exists(args[1]) {
+				d.setExpiry(args[1], args[2])
+			} else {
+				response = "-K"
+			}
 
-func SaveDB() {
-	b := new(bytes.Buffer)
+		case "persist":
+			if d.exists(args[1]) {
+				d.clearDeadline(args[1])
+			} else {
+				response = "-K"
+			}
 
-    e := gob.NewEncoder(b)
+		case "ttl":
+			if d.exists(args[1]) {
+				response = fmt.Sprint("R", d.ttl(args[1]))
+			} else {
+				response = "-K"
+			}
 
-    // Encoding the map
-    err := e.Encode(db)
-    if err != nil {
-        //panic(err)
-        return
-    }
-	ioutil.WriteFile("db.txt", b.Bytes(), 0777)
-}
+		case "type":
+			response = "R" + d.typeOf(args[1])
+
+		case "hset", "hget", "hdel", "hgetall",
+			"lpush", "rpush", "lpop", "rpop", "lrange",
+			"sadd", "srem", "smembers", "sismember":
+			response = d.collectionCommand(cmd, args)
+
+		case "txn":
+			d.replayTx(args)
+
+		default:
+			response = "-C"
 
-func MultiSQL(sql string) (response string, status bool) {
-	response = ""
-	status = true
-	sql = strings.Trim(sql, "; ")
-	msql := strings.Split(sql, ";")
-	for i := 0; i < len(msql); i++ {
-		r, ok := GoSQL(msql[i])
-		response += r + "; "
-		if !ok {
-			status = false
-			return
-		}
 	}
 	return
 }
 
-func BigRead(conn net.Conn) (s string, ok bool) {
-	ok = false
-	s = ""
-	var buf [512]byte
-	n, err := conn.Read(buf[0:])
+// Returns the keys a command reads or writes, used to lock their shards.
+func commandKeys(cmd string, args []string) []string {
+	if selfLocking[cmd] {
+		return nil
+	}
+	switch cmd {
+	case "ping", "quit", "use":
+		return nil
+	case "copy", "rename":
+		return args[1:3]
+	case "exists":
+		return args[1:]
+	}
+	return args[1:2]
+}
+
+// Runs a query holding one or more commands separated by ';'.
+// The response of several commands is a list (see wire.EncodeList) of their responses.
+// Commands after a quit are not run.
+func (s *Session) MultiSQL(sql string) (response string, status bool) {
+	status = true
+	cmds, err := Lex(sql)
 	if err != nil {
-		return
+		return "-P", true
 	}
-	size := int(buf[0])
-	s = string(buf[1:n])
-	for i := 0; i < size; i++ {
-		n, err = conn.Read(buf[0:])
-		if err != nil {
-			return
+	if len(cmds) == 0 {
+		return "-C", true
+	}
+	if len(cmds) == 1 {
+		return s.RunCommand(cmds[0])
+	}
+	var responses []string
+	for _, args := range cmds {
+		r, ok := s.RunCommand(args)
+		responses = append(responses, r)
+		if !ok {
+			status = false
+			break
 		}
-		s += string(buf[:n])
 	}
-	ok = true
-	return
+	return wire.EncodeList(responses), status
 }
 
-func BigWrite(conn net.Conn, s string) bool {
-	size := len(s) + 1
-	s = string(size/512) + s
-	i := 0
-	for ;i < size/512; i++ {
-		conn.Write([]byte(s[i*512 : (i+1)*512]))
+// Tells a client that connected beyond the maxclients setting that it can't be served:
+// its first query gets "-L".
+func rejectClient(conn net.Conn) {
+	if wire.ServerHandshake(conn) == nil {
+		wire.WriteFrame(conn, []byte("-L"))
 	}
-	conn.Write([]byte(s[i*512 : i*512 + size%512]))
-	return true
 }
 
 func handleClient(conn net.Conn) {
 
 	defer conn.Close()
 
-	//var buf [512]byte
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if err := wire.ServerHandshake(conn); err != nil {
+		if err == wire.ErrNotGodb {
+			// reply in the old framing: a size byte followed by the response
+			conn.Write(append([]byte{0}, LEGACY_ERROR...))
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// responses and published messages are written from different goroutines
+	var mu sync.Mutex
+	write := func(frame string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return wire.WriteFrame(conn, []byte(frame))
+	}
+
+	s := NewSession()
+	s.push = func(msg []string) error {
+		// "M" followed by the items of the message as in a list
+		return write("M" + wire.EncodeList(msg)[1:])
+	}
+	s.kill = func() { conn.Close() }
+	defer s.Close()
+
+	// queries are read by another goroutine so that a client disconnecting is noticed
+	// while a command waits (see blockingCommand)
+	type query struct {
+		sql []byte
+		err error
+	}
+	queries := make(chan query)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			sql, err := wire.ReadFrame(conn, frameLimit())
+			if err != nil && err != wire.ErrFrameTooLarge {
+				close(closed)
+				return
+			}
+			select {
+			case queries <- query{sql, err}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	s.closed = closed
+
 	for {
-		sql, ok := BigRead(conn)
-		if !ok {
+		var q query
+		select {
+		case q = <-queries:
+		case <-closed:
+			return
+		}
+		if q.err == wire.ErrFrameTooLarge {
+			write("-S")
+			continue
+		}
+		r, ok := s.MultiSQL(string(q.sql))
+		if err := write(r); err != nil {
 			return
 		}
-		r, ok := MultiSQL(sql)
-		r = strings.Trim(r, "; ")
-		BigWrite(conn, r)
 		if !ok {
-			mutex.Lock()
-			SaveDB()
-			mutex.Unlock()
 			return
 		}
 	}
 }
 
 func main() {
-	db = make(map[string]string)
-
-	listener, err := net.Listen("tcp", ":"+GODB_PORT)
+	flag.Parse()
+	if *hashPasswordFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			checkError(err)
+		}
+		fmt.Println(hashPassword(strings.TrimRight(password, "\r\n")))
+		return
+	}
+	if *configFile != "" {
+		checkError(loadConfig(*configFile))
+	}
+	checkError(os.MkdirAll(*dataDir, 0755))
+	var err error
+	serverTLS, err = tlsConfig()
 	checkError(err)
+	if *usersFile != "" {
+		users, err = loadUsers(*usersFile)
+		checkError(err)
+	}
 
-	LoadDB()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
+	listener, err := listen(*listenAddr)
+	checkError(err)
 
-		go handleClient(conn)
+	_, err = openDB(DEFAULT_DB)
+	checkError(err)
+	go snapshotter()
+	go sweepExpired()
+	if *respAddr != "" {
+		go serveRESP(*respAddr)
 	}
+
+	go handleSignals()
+
+	serve(listener, handleClient, rejectClient)
+	select {} // until shutdown exits
 }
 
 func checkError(err error) {
@@ -1,10 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/marella/godb/godb"
+	"github.com/marella/godb/wire"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,26 +36,24 @@ var w sync.WaitGroup
 
 func TestMain(t *testing.T) {
 
-	// start the server
-	cmd := exec.Command("go", "run", "server.go") // for linux use $ ./godb
-	err := cmd.Start()
+	// start the server, keeping its files out of the source tree
+	dir, err := ioutil.TempDir("", "godb")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	addr, cmd := startServer(t, dir)
 
-	fmt.Println("Test begins in 5 seconds...")
-	time.Sleep(5000 * time.Millisecond) // wait for firewall permissions
-	
 	w.Add(1000)
 	// 1000 clients
 	for i := 0; i < 1000; i++ {
 		go func(i int) {
-			g := godb.New("127.0.0.1", "db_name")
+			g := godb.New(addr, "db_name")
 			// 10 queries
 			for j := 0; j < 10; j++ {
 				g.Query(fmt.Sprintf("set test[%d][%d] This is an automated test for client %d and query %d", i, j, i, j))
 			}
-			g.Query("quit") // to save the map in db.txt
+			g.Query("quit") // to close the connection
 			fmt.Print(i, ",") // to know that a client is finished
 			w.Done()
 		}(i)
@@ -41,11 +62,1722 @@ func TestMain(t *testing.T) {
 	fmt.Println("")
 
 	// now check if above queries went well
-	g := godb.New("127.0.0.1", "db_name")
+	g := godb.New(addr, "db_name")
 	r, ok := g.Query("get test[1][2]")
 	if ok {
 		fmt.Println("get test[1][2] returned:", r)
 	} else {
 		fmt.Println("Something went wrong. Test failed.")
 	}
-}
\ No newline at end of file
+
+	if v, err := g.Get("test[1][2]"); err != nil || v != "This is an automated test for client 1 and query 2" {
+		t.Error("Get returned:", v, err)
+	}
+
+	g.Do("shutdown nosave")
+	waitExit(t, cmd)
+}
+
+// Builds the server into dir unless it is there already and runs it on a free local port,
+// keeping its files in dir. Returns once it accepts connections.
+func startServer(t *testing.T, dir string) (addr string, cmd *exec.Cmd) {
+	bin := filepath.Join(dir, "godb")
+	if _, err := os.Stat(bin); err != nil {
+		if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+			t.Fatalf("go build: %s\n%s", err, out)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = listener.Addr().String()
+	listener.Close()
+
+	cmd = exec.Command(bin, "-dir", dir, "-addr", addr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, cmd
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	t.Fatal("Server did not start on", addr)
+	return
+}
+
+// Waits for a server started by startServer to exit by itself.
+func waitExit(t *testing.T, cmd *exec.Cmd) {
+	exited := make(chan error)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Error("Server exited with", err)
+		}
+	case <-time.After(SHUTDOWN_TIMEOUT + 5*time.Second):
+		cmd.Process.Kill()
+		<-exited
+		t.Error("Server did not shut down")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the write-ahead log keeps the data for the next start
+	addr, cmd := startServer(t, dir)
+	p := godb.NewPool(addr, 1, 1)
+	if err := p.Set("k", "v"); err != nil {
+		t.Error("Set:", err)
+	}
+	p.Do("shutdown nosave")
+	p.Close()
+	waitExit(t, cmd)
+	if _, err := os.Stat(filepath.Join(dir, DB_FILE)); !os.IsNotExist(err) {
+		t.Error("Expected no snapshot after shutdown nosave, got", err)
+	}
+
+	// and shutdown writes a snapshot of what changed
+	addr, cmd = startServer(t, dir)
+	p = godb.NewPool(addr, 1, 1)
+	if v, err := p.Get("k"); v != "v" || err != nil {
+		t.Error("Get after restart returned", v, err)
+	}
+	p.Set("k2", "v2")
+	p.Do("shutdown")
+	p.Close()
+	waitExit(t, cmd)
+	snap, err := readSnapshot(filepath.Join(dir, DB_FILE))
+	if err != nil || snap.Data["k"] != "v" || snap.Data["k2"] != "v2" {
+		t.Error("Snapshot after shutdown:", snap, err)
+	}
+}
+
+// Serves godb clients on a free local port from an empty default database that is not backed
+// by files, and returns that database, the address and a pool of connections to it.
+// The previous default database is put back when the test ends.
+func testServer(t *testing.T) (d *DB, addr string, p *godb.Pool) {
+	d = newDB(DEFAULT_DB)
+	dbsMu.Lock()
+	old, ok := dbs[DEFAULT_DB]
+	dbs[DEFAULT_DB] = d
+	dbsMu.Unlock()
+	t.Cleanup(func() {
+		dbsMu.Lock()
+		defer dbsMu.Unlock()
+		if ok {
+			dbs[DEFAULT_DB] = old
+		} else {
+			delete(dbs, DEFAULT_DB)
+		}
+	})
+
+	listener, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn)
+		}
+	}()
+	addr = listener.Addr().String()
+	p = godb.NewPool(addr, 10, 10)
+	t.Cleanup(func() { p.Close() })
+	return
+}
+
+func TestClientErrors(t *testing.T) {
+	_, _, p := testServer(t)
+	p.Set("k", "v")
+	if v, err := p.Get("k"); err != nil || v != "v" {
+		t.Error("Get returned:", v, err)
+	}
+	if _, err := p.Get("missing"); err != godb.ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+	if _, err := p.Do("nosuchcommand"); err != godb.ErrUnknownCommand {
+		t.Error("Expected ErrUnknownCommand, got", err)
+	}
+	if _, err := p.Do("get"); err != godb.ErrArgs {
+		t.Error("Expected ErrArgs, got", err)
+	}
+	if _, err := p.Do(`get "k`); err != godb.ErrSyntax {
+		t.Error("Expected ErrSyntax, got", err)
+	}
+}
+
+func TestClientConnErrors(t *testing.T) {
+	// a server that is not running
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	var connErr *godb.ConnError
+	if _, err := godb.Dial(context.Background(), addr); !errors.As(err, &connErr) || connErr.Op != "dial" {
+		t.Error("Expected a dial ConnError, got", err)
+	}
+
+	// a server that never replies
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wire.ServerHandshake(conn)
+		io.Copy(ioutil.Discard, conn)
+	}()
+	g, err := godb.Dial(context.Background(), listener.Addr().String(), godb.WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	start := time.Now()
+	_, err = g.Do("get k")
+	var netErr net.Error
+	if !errors.As(err, &connErr) || connErr.Op != "read" || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Error("Expected a read timeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("Read timed out after", elapsed)
+	}
+}
+
+func TestPool(t *testing.T) {
+	_, _, p := testServer(t)
+
+	// 100 goroutines sharing 10 connections
+	var w sync.WaitGroup
+	w.Add(100)
+	for i := 0; i < 100; i++ {
+		go func(i int) {
+			defer w.Done()
+			key := fmt.Sprintf("pool[%d]", i)
+			if err := p.Set(key, key); err != nil {
+				t.Error("Pool Set:", err)
+			}
+			if v, err := p.Get(key); err != nil || v != key {
+				t.Error("Pool Get returned:", v, err)
+			}
+		}(i)
+	}
+	w.Wait()
+	if s := p.Stats(); s.Open > 10 || s.InUse != 0 || s.Dials > 10 {
+		t.Errorf("Unexpected pool stats: %+v", s)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	_, _, p := testServer(t)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("pool[%d]", i)
+		p.Set(key, key)
+	}
+	p.Set("other", "x")
+
+	seen := make(map[string]bool)
+	it := p.Scan("pool[[]*", 7)
+	for it.Next() {
+		seen[it.Key()] = true
+	}
+	if len(seen) != 100 || it.Err() != nil {
+		t.Error("Expected 100 pool keys from Scan, got", len(seen), it.Err())
+	}
+	if keys, err := p.Keys("pool[[]*"); len(keys) != 100 || keys[0] != "pool[0]" || err != nil {
+		t.Error("Expected 100 sorted pool keys, got", len(keys), err)
+	}
+	if n, err := p.Exists("pool[1]", "other", "missing"); n != 2 || err != nil {
+		t.Error("Exists returned", n, err)
+	}
+	if n, err := p.DBSize(); n != 101 || err != nil {
+		t.Error("DBSize returned", n, err)
+	}
+}
+
+func TestClientRange(t *testing.T) {
+	_, _, p := testServer(t)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("pool[%d]", i)
+		p.Set(key, key)
+	}
+	p.Set("poolside", "x")
+
+	pair := func(key string) godb.Pair { return godb.Pair{Key: key, Value: key} }
+	if pairs, err := p.RevPrefix("pool[", 2); fmt.Sprint(pairs) != fmt.Sprint([]godb.Pair{pair("pool[9]"), pair("pool[99]")}) || err != nil {
+		t.Error("RevPrefix returned", pairs, err)
+	}
+	if pairs, err := p.Prefix("pool[", 0); len(pairs) != 100 || pairs[0] != pair("pool[0]") || err != nil {
+		t.Error("Prefix returned", len(pairs), err)
+	}
+	// "]" sorts after the digits, so pool[20] to pool[29] come before pool[2]
+	if pairs, err := p.Range("pool[1]", "pool[2]", 0); len(pairs) != 11 || pairs[1] != pair("pool[20]") || err != nil {
+		t.Error("Range returned", pairs, err)
+	}
+	if pairs, err := p.RevRange("pool[1]", "", 1); len(pairs) != 1 || pairs[0].Key != "poolside" || err != nil {
+		t.Error("RevRange returned", pairs, err)
+	}
+}
+
+func TestClientNumeric(t *testing.T) {
+	_, _, p := testServer(t)
+
+	// increments from concurrent clients are not lost
+	var w sync.WaitGroup
+	w.Add(100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer w.Done()
+			if _, err := p.Incr("counter"); err != nil {
+				t.Error("Incr:", err)
+			}
+		}()
+	}
+	w.Wait()
+	if n, err := p.IncrBy("counter", 0); n != 100 || err != nil {
+		t.Error("Expected counter to be 100, got", n, err)
+	}
+	if n, err := p.DecrBy("counter", 150); n != -50 || err != nil {
+		t.Error("DecrBy returned", n, err)
+	}
+	if f, err := p.IncrByFloat("float", 0.5); f != 0.5 || err != nil {
+		t.Error("IncrByFloat returned", f, err)
+	}
+	p.Set("text", "abc")
+	if _, err := p.Incr("text"); err != godb.ErrNotNumber {
+		t.Error("Expected ErrNotNumber, got", err)
+	}
+}
+
+func TestClientQuoting(t *testing.T) {
+	_, _, p := testServer(t)
+
+	// values and keys with any bytes round-trip exactly
+	for _, value := range []string{"  x\ty;\n\"$1:\x00 ", "", "$", "$3:abc", "'", "\xff\xfe"} {
+		if err := p.Set("a key;", value); err != nil {
+			t.Errorf("Set %q: %v", value, err)
+		}
+		if v, err := p.Get("a key;"); err != nil || v != value {
+			t.Errorf("Get returned %q, %v instead of %q", v, err, value)
+		}
+	}
+}
+
+func TestClientTypes(t *testing.T) {
+	_, _, p := testServer(t)
+	if n, err := p.RPush("jobs", "a", "b"); n != 2 || err != nil {
+		t.Error("RPush returned", n, err)
+	}
+	if v, err := p.LPop("jobs"); v != "a" || err != nil {
+		t.Error("LPop returned", v, err)
+	}
+	if _, err := p.Get("jobs"); err != godb.ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+}
+
+func TestClientPubSub(t *testing.T) {
+	_, _, p := testServer(t)
+	sub, err := p.Subscribe(context.Background(), "events")
+	if err != nil {
+		t.Fatal("Subscribe:", err)
+	}
+	defer sub.Close()
+	if n, err := p.Publish("events", "started"); n != 1 || err != nil {
+		t.Error("Publish returned", n, err)
+	}
+	select {
+	case msg := <-sub.C:
+		if msg.Channel != "events" || msg.Payload != "started" {
+			t.Error("Unexpected message", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No message received")
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	_, _, p := testServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := p.Watch(ctx, "watched:")
+	if err != nil {
+		t.Fatal("Watch:", err)
+	}
+	p.Set("watched:a", "1")
+	select {
+	case e := <-events:
+		if e != (godb.Event{Type: "set", Key: "watched:a", Value: "1"}) {
+			t.Error("Unexpected event", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No event received")
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestClientBlockingPop(t *testing.T) {
+	_, _, p := testServer(t)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.RPush("queue", "job")
+	}()
+	if key, v, err := p.BLPop(5*time.Second, "queue"); key != "queue" || v != "job" || err != nil {
+		t.Error("BLPop returned", key, v, err)
+	}
+	if _, _, err := p.BLPop(10*time.Millisecond, "queue"); err != godb.ErrTimeout {
+		t.Error("Expected ErrTimeout, got", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	d := newDB("expiry")
+	s := &Session{db: d}
+	for _, test := range [][2]string{
+		{"set k v ex 100", APPLIED},
+		{"ttl k", "R100"},
+		{"expire k 10", APPLIED},
+		{"ttl k", "R10"},
+		{"persist k", APPLIED},
+		{"ttl k", "R-1"},
+		{"expire missing 10", "-K"},
+		{"persist missing", "-K"},
+		{"ttl missing", "-K"},
+		{"expire k ten", "-A"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	// a deadline in the past hides the key right away and the sweeper removes it
+	unlock := d.lock([]string{"k"}, true)
+	d.setDeadline("k", now()-1)
+	unlock()
+	if r, _ := s.GoSQL("get k"); r != "-K" {
+		t.Errorf("get of an expired key: expected %q, got %q", "-K", r)
+	}
+	d.sweep()
+	if r, _ := s.GoSQL("dbsize"); r != "R0" {
+		t.Errorf("dbsize after sweep: expected %q, got %q", "R0", r)
+	}
+}
+
+func TestReplayExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := newDB("replay")
+	if d.wal, err = OpenWAL(filepath.Join(dir, "db.wal")); err != nil {
+		t.Fatal(err)
+	}
+	defer d.wal.Close()
+	s := &Session{db: d}
+	s.MultiSQL("set k v ex 1; persist k; set e v ex 1; expire e 1000; set x v ex 1")
+	s.MultiSQL("multi; set t v ex 1; persist t; exec")
+	// writes to keys that were still live when they ran
+	s.MultiSQL("set c 5 ex 1; incr c; set l x ex 1; setnx l y; rpush q a; expire q 1; rpush q b")
+	time.Sleep(1100 * time.Millisecond)
+	// x expired before persist ran, so persist fails now and when replayed
+	if r, _ := s.GoSQL("persist x"); r != "-K" {
+		t.Fatalf("persist x: expected %q, got %q", "-K", r)
+	}
+
+	// the old deadlines have passed by the time the log is replayed
+	replayed := newDB("replay")
+	err = d.wal.Replay(0, func(args []string) {
+		replayed.replay(args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &Session{db: replayed}
+	for _, test := range [][2]string{
+		{"get k", "Rv"},
+		{"ttl k", "R-1"},
+		{"get e", "Rv"},
+		{"ttl e", "R999"},
+		{"get t", "Rv"},
+		{"get x", "-K"},
+		{"exists c l q", "R0"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("after replay, %s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "db.wal")
+
+	w, err := OpenWAL(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"set", "a", "1"}, {"set", "b", "2"}, {"del", "a"}} {
+		if err := w.Append(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good := w.Size()
+	w.Close()
+
+	replay := func(after uint64) (w *WAL, applied []string) {
+		w, err := OpenWAL(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Replay(after, func(args []string) {
+			applied = append(applied, strings.Join(args, " "))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return w, applied
+	}
+
+	// a record torn by a crash mid-write is cut off and the ones before it replayed
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0})
+	f.Close()
+	w, applied := replay(0)
+	if strings.Join(applied, ",") != "set a 1,set b 2,del a" || w.Seq() != 3 || w.Size() != good {
+		t.Fatal("After a torn tail, replayed", applied, "up to", w.Seq(), "leaving", w.Size(), "bytes")
+	}
+
+	// appends go after the last good record
+	if err := w.Append([]string{"set", "c", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, applied = replay(2)
+	if strings.Join(applied, ",") != "del a,set c 3" || w.Seq() != 4 {
+		t.Fatal("After appending, replayed", applied, "up to", w.Seq())
+	}
+	w.Close()
+
+	// so does a last record whose checksum does not match
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(name, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	w, applied = replay(0)
+	if len(applied) != 3 || w.Seq() != 3 || w.Size() != good {
+		t.Fatal("After a corrupt tail, replayed", applied, "up to", w.Seq(), "leaving", w.Size(), "bytes")
+	}
+	w.Close()
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "db.txt")
+
+	for i := 1; i <= 2; i++ {
+		snap := &Snapshot{Seq: uint64(i), Data: map[string]string{"k": fmt.Sprint(i)}}
+		if err := writeSnapshot(name, snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := readSnapshot(name)
+	if err != nil || snap.Seq != 2 || snap.Data["k"] != "2" {
+		t.Fatal("Could not read back the snapshot:", snap, err)
+	}
+
+	// flip a byte in the body
+	buf, _ := ioutil.ReadFile(name)
+	buf[len(buf)-1] ^= 0xff
+	ioutil.WriteFile(name, buf, 0666)
+	if _, err := readSnapshot(name); err != errSnapshotChecksum {
+		t.Error("Corrupt snapshot was not rejected:", err)
+	}
+	snap, err = readSnapshot(name + SNAPSHOT_PREV)
+	if err != nil || snap.Seq != 1 {
+		t.Error("Previous snapshot is not usable:", snap, err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := newDB("checkpoint")
+	d.file = filepath.Join(dir, "db.txt")
+	if d.wal, err = OpenWAL(filepath.Join(dir, "db.wal")); err != nil {
+		t.Fatal(err)
+	}
+	defer d.wal.Close()
+	s := &Session{db: d}
+	s.MultiSQL("set a 1; set b 2; rpush l x y; expire b 100")
+
+	// writes made while the snapshot is copied are not part of it
+	snap, changes := d.startView()
+	s.MultiSQL("set a 9; del l; set c 3; persist b; hset h f v")
+	d.finishView(snap)
+	if changes != 4 || len(snap.Data) != 2 || snap.Data["a"] != "1" || len(snap.Lists["l"]) != 2 ||
+		snap.Expires["b"] == 0 || len(snap.Hashes) != 0 {
+		t.Fatalf("Snapshot does not hold the contents when it began: %d %+v", changes, snap)
+	}
+	if err := writeSnapshot(d.file, snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.wal.Discard(snap.Seq); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot and the records left in the log give the current contents
+	loaded := newDB("checkpoint")
+	loaded.file = d.file
+	seq, err := loaded.LoadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := 0
+	err = d.wal.Replay(seq, func(args []string) {
+		loaded.replay(args)
+		replayed++
+	})
+	if err != nil || replayed != 5 {
+		t.Fatalf("Expected the 5 writes made during the snapshot in the log, replayed %d: %v", replayed, err)
+	}
+	s = &Session{db: loaded}
+	for _, test := range [][2]string{
+		{"get a", "R9"},
+		{"exists l", "R0"},
+		{"get c", "R3"},
+		{"ttl b", "R-1"},
+		{"hget h f", "Rv"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("after reload, %s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	s = &Session{db: d}
+	for _, test := range [][2]string{
+		{"save", "1"},
+		{"multi", "1"},
+		{"bgsave", "-T"},
+		{"discard", "1"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+	if atomic.LoadInt64(&d.dirty) != 0 {
+		t.Error("save did not reset the count of writes:", d.dirty)
+	}
+
+	// the log keeps the records since the previous snapshot, which is used if the last one is
+	// corrupt
+	s.MultiSQL("set x 10; save; set a 11")
+	buf, _ := ioutil.ReadFile(d.file)
+	buf[len(buf)-1] ^= 0xff
+	ioutil.WriteFile(d.file, buf, 0666)
+	loaded = newDB("checkpoint")
+	loaded.file = d.file
+	if seq, err = loaded.LoadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.wal.Replay(seq, func(args []string) { loaded.replay(args) }); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range [][2]string{
+		{"get x", "R10"},
+		{"get a", "R11"},
+	} {
+		if r, _ := (&Session{db: loaded}).GoSQL(test[0]); r != test[1] {
+			t.Errorf("after falling back to the previous snapshot, %s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	// writes missing from both the snapshot and the log are an error
+	s.MultiSQL("save; save")
+	if d.wal.Size() != 0 {
+		t.Error("save did not discard the log:", d.wal.Size())
+	}
+	s.GoSQL("set a 12")
+	if err = d.wal.Replay(0, func(args []string) { loaded.replay(args) }); err == nil {
+		t.Error("Missing records were not reported")
+	}
+
+	// the log is compacted once it grows past walsize, even if no snapshot policy applies
+	defer walSize.Set(strconv.Itoa(WAL_SIZE))
+	walSize.Set("100")
+	s.GoSQL("save")
+	if d.due(nil, time.Now()) {
+		t.Error("Snapshot due right after save")
+	}
+	s.GoSQL("set a " + strings.Repeat("x", 100))
+	if !d.due(nil, time.Now()) {
+		t.Error("Snapshot not due after the log grew by", d.wal.Size()-d.walSaved)
+	}
+	s.GoSQL("save")
+	if d.due(nil, time.Now()) {
+		t.Error("Snapshot due after the log was compacted")
+	}
+}
+
+// The benchmarks below run commands against an in-memory database from parallel goroutines.
+// Run them with different numbers of cores to see how throughput scales:
+//	go test -run NONE -bench . -cpu 1,2,4,8
+func benchSession(b *testing.B, keys int) *Session {
+	s := &Session{db: newDB("bench")}
+	for i := 0; i < keys; i++ {
+		s.RunCommand([]string{"set", fmt.Sprint("key", i), "value"})
+	}
+	b.ResetTimer()
+	return s
+}
+
+func BenchmarkGet(b *testing.B) {
+	s := benchSession(b, 10000)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			s.RunCommand([]string{"get", fmt.Sprint("key", i%10000)})
+		}
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	s := benchSession(b, 0)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			s.RunCommand([]string{"set", fmt.Sprint("key", i%10000), "value"})
+		}
+	})
+}
+
+// 90% reads and 10% writes.
+func BenchmarkMixed(b *testing.B) {
+	s := benchSession(b, 10000)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := fmt.Sprint("key", i%10000)
+			if i%10 == 0 {
+				s.RunCommand([]string{"set", key, "value"})
+			} else {
+				s.RunCommand([]string{"get", key})
+			}
+		}
+	})
+}
+
+func TestUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := *dataDir
+	*dataDir = dir
+	d, _, _ := testServer(t)
+	defer func() {
+		dbsMu.Lock()
+		if other, ok := dbs["other"]; ok {
+			other.wal.Close()
+			delete(dbs, "other")
+		}
+		dbsMu.Unlock()
+		*dataDir = old
+	}()
+
+	s := &Session{db: d}
+	s.GoSQL("set k default")
+	for _, test := range [][2]string{
+		{"use ../other", "-A"},
+		{"use other", APPLIED},
+		{"get k", "-K"},
+		{"set k other", APPLIED},
+		{"save", APPLIED},
+		{"set k2 logged", APPLIED},
+		{"use default", APPLIED},
+		{"get k", "Rdefault"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	// each database has files of its own
+	for _, file := range []string{"db.other.txt", "db.other.wal"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, DB_FILE)); !os.IsNotExist(err) {
+		t.Error("Expected no snapshot of the default database, got", err)
+	}
+
+	// and is loaded back from them
+	dbsMu.Lock()
+	dbs["other"].wal.Close()
+	delete(dbs, "other")
+	dbsMu.Unlock()
+	s.GoSQL("use other")
+	for _, test := range [][2]string{{"get k", "Rother"}, {"get k2", "Rlogged"}} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("after reopening, %s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	d := newDB("tx")
+	a, b := &Session{db: d}, &Session{db: d}
+	run := func(s *Session, sql string, expected string) {
+		if r, _ := s.GoSQL(sql); r != expected {
+			t.Errorf("%s: expected %q, got %q", sql, expected, r)
+		}
+	}
+
+	run(a, "begin", "1")
+	run(a, "set x 1", "Q")
+	run(a, "get x", "Q")
+	run(b, "get x", "-K") // nothing is applied before commit
+	run(a, "commit", "L1:12:R1")
+
+	// a failing command rolls back the whole transaction
+	run(a, "begin", "1")
+	run(a, "set x 2", "Q")
+	run(a, "rename nosuchkey y", "Q")
+	run(a, "commit", "-K")
+	run(a, "get x", "R1")
+
+	// a watched key changed by another session aborts the transaction
+	run(a, "watch x", "1")
+	run(b, "set x 3", "1")
+	run(a, "begin", "1")
+	run(a, "set x 4", "Q")
+	run(a, "commit", "-X")
+	run(a, "get x", "R3")
+
+	// watches are released by commit
+	run(a, "begin", "1")
+	run(a, "set x 4", "Q")
+	run(a, "commit", "L1:1")
+	run(a, "commit", "-T")
+
+	// a transaction that is rolled back does not change the keys watched by others
+	run(a, "watch x", "1")
+	run(b, "begin", "1")
+	run(b, "set x 5", "Q")
+	run(b, "incr x", "Q")
+	run(b, "rename nosuchkey y", "Q")
+	run(b, "commit", "-K")
+	run(a, "begin", "1")
+	run(a, "set x 6", "Q")
+	run(a, "commit", "L1:1")
+
+	// deadlines count from the commit, not from when the commands were queued
+	run(a, "begin", "1")
+	run(a, "set e v ex 1", "Q")
+	run(a, "set f v", "Q")
+	run(a, "expire f 1", "Q")
+	time.Sleep(1100 * time.Millisecond)
+	run(a, "commit", "L1:11:11:1")
+	run(a, "ttl e", "R1")
+	run(a, "ttl f", "R1")
+}
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		sql  string
+		cmds [][]string
+	}{
+		{"set a  b\tc", [][]string{{"set", "a", "b", "c"}}},
+		{`set "a key" "x  y\t;\n"`, [][]string{{"set", "a key", "x  y\t;\n"}}},
+		{`set k 'it\'s \n'; get k`, [][]string{{"set", "k", `it's \n`}, {"get", "k"}}},
+		{"set k $7:a;\"b\x00 c", [][]string{{"set", "k", "a;\"b\x00 c"}}},
+		{`set k "" $0:`, [][]string{{"set", "k", "", ""}}},
+		{`set k ab"c d"`, [][]string{{"set", "k", "abc d"}}},
+		{`set k $5`, [][]string{{"set", "k", "$5"}}},
+		{" ; ;", nil},
+	}
+	for _, test := range tests {
+		cmds, err := Lex(test.sql)
+		if err != nil || fmt.Sprintf("%q", cmds) != fmt.Sprintf("%q", test.cmds) {
+			t.Errorf("Lex(%q) = %q, %v", test.sql, cmds, err)
+		}
+	}
+	for _, sql := range []string{`set k "abc`, `set k "\q"`, `set k $9:abc`, `set k $1:ab`} {
+		if _, err := Lex(sql); err != errSyntax {
+			t.Errorf("Lex(%q) did not fail: %v", sql, err)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer maxValue.Set("0")
+	defer maxFrame.Set(strconv.Itoa(wire.MAX_FRAME))
+	defer maxClients.Set("0")
+	defer savePolicy.Set(SAVE_POLICY)
+
+	s := &Session{db: newDB("config")}
+	for _, test := range [][2]string{
+		{"config get max*", "L10:maxclients1:08:maxframe8:671088648:maxvalue1:0"},
+		{"config get nosuchsetting", "L"},
+		{"config set maxvalue 3", "1"},
+		{"set k abc", "1"},
+		{"set k abcd", "-S"},
+		{"set abcd v", "-S"},
+		{"get k", "Rabc"},
+		{"config set MAXVALUE -1", "-A"},
+		{"config set maxframe 10", "1"},
+		{"config get maxframe", "L8:maxframe2:10"},
+		{"config set addr :2001", "-A"},
+		{"config set loglevel loud", "-A"},
+		{"config set save 60", "-A"},
+		{"config set save '10 1'", "1"},
+		{"config get save", "L4:save4:10 1"},
+		{"multi", "1"},
+		{"config get save", "-T"},
+		{"discard", "1"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	// requests over maxframe are rejected without closing the connection
+	_, addr, _ := testServer(t)
+	g, err := godb.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err := g.Set("k", "too long"); err != godb.ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got", err)
+	}
+	if err := g.Ping(); err != nil {
+		t.Error("Ping after a large request:", err)
+	}
+
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "godb.conf")
+	ioutil.WriteFile(name, []byte("# limits\nmaxclients 5\n\nsave \"\"\n"), 0666)
+	if err := loadConfig(name); err != nil {
+		t.Fatal(err)
+	}
+	if maxClients.get() != 5 || len(savePolicy.rules()) != 0 {
+		t.Error("Settings of the config file were not applied:", maxClients, savePolicy)
+	}
+	ioutil.WriteFile(name, []byte("maxclients 5\nport 2001\n"), 0666)
+	if err := loadConfig(name); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Error("Expected an error on line 2, got", err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	s := &Session{db: newDB("cond")}
+	for _, test := range [][2]string{
+		{"setxx lock a", "0"},
+		{"setnx lock a ex 10", "1"},
+		{"setnx lock b", "0"},
+		{"ttl lock", "R10"},
+		{"cas lock b c", "0"},
+		{"cas lock a c", "1"},
+		{"get lock", "Rc"},
+		{"ttl lock", "R-1"},
+		{"setxx lock d", "1"},
+		{"getset lock e", "Rd"},
+		{"getset other f", "1"},
+		{"cas lock e f ex", "-A"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "user:1/x", true},
+		{"user:*", "user:1", true},
+		{"user:*", "use", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:12", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyyd", false},
+		{"a**c", "abc", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"*[0-9]", "key7", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"a[", "a[", true},
+		{"*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100), false},
+		{"*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100) + "b", true},
+	} {
+		if got := match(test.pattern, test.s); got != test.match {
+			t.Errorf("match(%q, %q): expected %v, got %v", test.pattern, test.s, test.match, got)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := &Session{db: newDB("scan")}
+	want := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		s.GoSQL("set " + key + " x")
+		want[key] = true
+	}
+	s.MultiSQL("set other x; set gone x; expire gone 0")
+
+	for _, test := range [][2]string{
+		{"dbsize", "R501"},
+		{"exists user:1 user:2 nope gone", "R2"},
+		{"keys user:1?", "L7:user:107:user:117:user:127:user:137:user:147:user:157:user:167:user:177:user:187:user:19"},
+		{"keys [^u]*", "L5:other"},
+		{"keys nope", "L"},
+		{"scan x", "-A"},
+		{"scan 0 count 0", "-A"},
+		{"begin; keys *", "L1:12:-T"},
+	} {
+		if r, _ := s.MultiSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+	s.GoSQL("rollback")
+
+	cursor, seen := "0", map[string]bool{}
+	for i := 0; ; i++ {
+		if i > 1000 {
+			t.Fatal("scan did not finish")
+		}
+		r, _ := s.RunCommand([]string{"scan", cursor, "match", "user:*", "count", "7"})
+		items, ok := wire.DecodeList(r)
+		if !ok || len(items) == 0 {
+			t.Fatalf("scan: unexpected response %q", r)
+		}
+		for _, key := range items[1:] {
+			if seen[key] || !want[key] {
+				t.Errorf("scan: unexpected or repeated key %s", key)
+			}
+			seen[key] = true
+		}
+		if cursor = items[0]; cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != len(want) {
+		t.Errorf("scan: expected %d keys, got %d", len(want), len(seen))
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := &Session{db: newDB("range")}
+	for i := 0; i < 300; i++ {
+		s.GoSQL(fmt.Sprintf("set ts:%03d v%d", i, i))
+	}
+	s.MultiSQL("set ts: none; set tt x; set ts:150 gone; expire ts:150 0; del ts:151")
+
+	for _, test := range [][2]string{
+		{"range ts:148 ts:153", "L6:ts:1484:v1486:ts:1494:v1496:ts:1524:v152"},
+		{"range ts:148 ts:153 2", "L6:ts:1484:v1486:ts:1494:v149"},
+		{"revrange ts:148 ts:153 2", "L6:ts:1524:v1526:ts:1494:v149"},
+		{"revrange ts:298 \"\"", "L2:tt1:x6:ts:2994:v2996:ts:2984:v298"},
+		{"prefix ts:29 1", "L6:ts:2904:v290"},
+		{"revprefix ts: 1", "L6:ts:2994:v299"},
+		{"prefix ts:3", "L"},
+		{"range b a", "L"},
+		{"range a b x", "-A"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	r, _ := s.GoSQL("prefix ts:")
+	if items, _ := wire.DecodeList(r); len(items) != 2*299 || items[0] != "ts:" || items[2] != "ts:000" {
+		t.Errorf("prefix ts: returned %d items", len(items))
+	}
+}
+
+func TestTypes(t *testing.T) {
+	s := &Session{db: newDB("types")}
+	for _, test := range [][2]string{
+		{"hset h a 1 b 2", "R2"},
+		{"hset h a 3", "R0"},
+		{"hget h a", "R3"},
+		{"hget h c", "-K"},
+		{"hgetall h", "L1:a1:31:b1:2"},
+		{"hset h a", "-A"},
+		{"rpush l b c", "R2"},
+		{"lpush l a", "R3"},
+		{"lrange l 0 -1", "L1:a1:b1:c"},
+		{"lrange l -2 5", "L1:b1:c"},
+		{"rpop l", "Rc"},
+		{"lpush l y z", "R4"},
+		{"lrange l 0 -1", "L1:z1:y1:a1:b"},
+		{"lpop l", "Rz"},
+		{"lpop l", "Ry"},
+		{"sadd s x y x", "R2"},
+		{"sismember s y", "1"},
+		{"srem s y z", "R1"},
+		{"smembers s", "L1:x"},
+		{"set str v", "1"},
+		{"type h", "Rhash"},
+		{"type l", "Rlist"},
+		{"type s", "Rset"},
+		{"type str", "Rstring"},
+		{"type nope", "Rnone"},
+		{"get h", "-Y"},
+		{"incr l", "-Y"},
+		{"hget str a", "-Y"},
+		{"sadd h x", "-Y"},
+		{"setnx h v", "0"},
+		{"copy h h2", "1"},
+		{"hset h2 c 4", "R1"},
+		{"hgetall h", "L1:a1:31:b1:2"},
+		{"rename s s2", "1"},
+		{"type s", "Rnone"},
+		{"exists h l s2 str", "R4"},
+		{"keys *", "L1:h2:h21:l2:s23:str"},
+		{"begin; hdel h a; lpop l; rpush str x; commit", "L1:11:Q1:Q1:Q2:-Y"},
+		{"begin; hdel h a; lpop l; commit", "L1:11:Q1:Q9:L2:R12:Ra"},
+		{"hdel h b", "R1"},
+		{"type h", "Rnone"},
+		{"set l v", "1"},
+		{"type l", "Rstring"},
+	} {
+		if r, _ := s.MultiSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.db.file = filepath.Join(dir, "db.txt")
+	s.MultiSQL("rpush q 1 2; expire q 100")
+	if err := s.db.SaveDB(); err != nil {
+		t.Fatal(err)
+	}
+	d := newDB("types")
+	d.file = s.db.file
+	if _, err := d.LoadDB(); err != nil {
+		t.Fatal(err)
+	}
+	s = &Session{db: d}
+	for _, test := range [][2]string{
+		{"hgetall h2", "L1:a1:31:b1:21:c1:4"},
+		{"lrange q 0 -1", "L1:11:2"},
+		{"ttl q", "R100"},
+		{"smembers s2", "L1:x"},
+		{"dbsize", "R5"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("after LoadDB, %s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	received := make(chan []string, 10)
+	s := &Session{db: newDB("pubsub")}
+	s.push = func(msg []string) error {
+		received <- msg
+		return nil
+	}
+	s.kill = func() {}
+	defer s.Close()
+	other := &Session{db: s.db}
+
+	for _, test := range [][2]string{
+		{"publish news hello", "R0"},
+		{"subscribe news sport", "R2"},
+		{"psubscribe n*", "R3"},
+		{"begin; publish news x", "L1:12:-T"},
+		{"rollback", "1"},
+	} {
+		if r, _ := s.MultiSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+	if r, _ := other.GoSQL("subscribe news"); r != "-C" {
+		t.Errorf("subscribe without push: expected %q, got %q", "-C", r)
+	}
+	if r, _ := other.GoSQL("publish news 'hi there'"); r != "R2" {
+		t.Errorf("publish: expected %q, got %q", "R2", r)
+	}
+	for _, want := range []string{"[message news hi there]", "[pmessage n* news hi there]"} {
+		select {
+		case msg := <-received:
+			if fmt.Sprint(msg) != want {
+				t.Errorf("expected message %s, got %v", want, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message received")
+		}
+	}
+
+	if r, _ := s.GoSQL("unsubscribe"); r != "R1" {
+		t.Errorf("unsubscribe: expected %q, got %q", "R1", r)
+	}
+	if r, _ := other.GoSQL("publish news x"); r != "R1" {
+		t.Errorf("publish after unsubscribe: expected %q, got %q", "R1", r)
+	}
+}
+
+func TestKeyEvents(t *testing.T) {
+	received := make(chan []string, 20)
+	s := &Session{db: newDB("events")}
+	s.push = func(msg []string) error {
+		received <- msg
+		return nil
+	}
+	s.kill = func() {}
+	defer s.Close()
+	other := &Session{db: s.db}
+
+	if r, _ := s.GoSQL("watchkeys user:"); r != "R1" {
+		t.Fatalf("watchkeys: expected %q, got %q", "R1", r)
+	}
+	other.MultiSQL("set user:1 a; set other b; setnx user:1 c; incr user:2; rename user:2 user:3; " +
+		"copy other user:4; expire user:4 0; begin; hset user:5 f v; del user:1; commit; get user:3")
+	s.db.sweep()
+	for _, want := range []string{
+		"[event set user:1 a]",
+		"[event incrby user:2 1]",
+		"[event rename_from user:2 ]",
+		"[event rename_to user:3 1]",
+		"[event copy_to user:4 b]",
+		"[event expire user:4 ]",
+		"[event hset user:5 ]",
+		"[event del user:1 ]",
+		"[event expired user:4 ]",
+	} {
+		select {
+		case msg := <-received:
+			if fmt.Sprint(msg) != want {
+				t.Errorf("expected %s, got %v", want, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("missing", want)
+		}
+	}
+
+	if r, _ := s.GoSQL("unwatchkeys"); r != "R0" {
+		t.Errorf("unwatchkeys: expected %q, got %q", "R0", r)
+	}
+	if s.db.watched != 0 {
+		t.Errorf("%d prefixes still watched", s.db.watched)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	d := newDB("block")
+	s, other := &Session{db: d}, &Session{db: d}
+
+	if r, _ := s.GoSQL("blpop q 0.05"); r != "0" {
+		t.Errorf("blpop on an empty list: expected %q, got %q", "0", r)
+	}
+	other.GoSQL("set str x")
+	for _, test := range [][2]string{
+		{"blpop str 0", "-Y"},
+		{"waitkey str 0", "1"},
+		{"waitkey str q 0", "-A"},
+		{"blpop q -1", "-A"},
+		{"begin; blpop q 0", "L1:12:-T"},
+		{"rollback", "1"},
+	} {
+		if r, _ := s.MultiSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	responses := make(chan string)
+	go func() {
+		r, _ := s.GoSQL("brpop q1 q2 0")
+		responses <- r
+	}()
+	time.Sleep(50 * time.Millisecond)
+	other.MultiSQL("set q1 x; del q1; rpush q2 a b")
+	select {
+	case r := <-responses:
+		if r != "L2:q21:b" {
+			t.Errorf("brpop: expected %q, got %q", "L2:q21:b", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("brpop was not woken up")
+	}
+	if r, _ := other.GoSQL("lrange q2 0 -1"); r != "L1:a" {
+		t.Errorf("lrange after brpop: expected %q, got %q", "L1:a", r)
+	}
+
+	closed := make(chan struct{})
+	s.closed = closed
+	go func() {
+		r, _ := s.GoSQL("waitkey nope 0")
+		responses <- r
+	}()
+	close(closed)
+	if r := <-responses; r != "0" {
+		t.Errorf("waitkey after disconnect: expected %q, got %q", "0", r)
+	}
+	if n := len(d.shardOf("nope").blocked); n != 0 {
+		t.Errorf("%d keys still blocked on", n)
+	}
+}
+
+func TestRESP(t *testing.T) {
+	s := &Session{db: newDB("resp")}
+	for _, test := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"SET", "r", "v", "NX"}, "+OK\r\n"},
+		{[]string{"GET", "r"}, "$1\r\nv\r\n"},
+		{[]string{"SET", "r", "w", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "new", "w", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "r", "w", "XX", "EX", "100"}, "+OK\r\n"},
+		{[]string{"TTL", "r"}, ":100\r\n"},
+		{[]string{"SET", "r", "x", "KEEPTTL"}, "+OK\r\n"},
+		{[]string{"TTL", "r"}, ":100\r\n"},
+		{[]string{"GET", "r"}, "$1\r\nx\r\n"},
+		{[]string{"SET", "r", "y", "PX", "1500"}, "+OK\r\n"},
+		{[]string{"TTL", "r"}, ":2\r\n"},
+		{[]string{"SET", "r", "z"}, "+OK\r\n"},
+		{[]string{"TTL", "r"}, ":-1\r\n"},
+		{[]string{"SET", "r", "v", "NX", "XX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "r", "v", "EX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "r", "v", "EX", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "r", "v", "EX", "1", "KEEPTTL"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "r", "v", "extra"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "r"}, "-ERR wrong number of arguments for 'set' command\r\n"},
+		{[]string{"GET", "r"}, "$1\r\nz\r\n"},
+
+		{[]string{"DEL", "r", "missing", "r"}, ":1\r\n"},
+		{[]string{"DEL", "missing"}, ":0\r\n"},
+		{[]string{"GET", "r"}, "$-1\r\n"},
+		{[]string{"TTL", "r"}, ":-2\r\n"},
+		{[]string{"INCR", "n"}, ":1\r\n"},
+		{[]string{"EXISTS", "n", "r"}, ":1\r\n"},
+		{[]string{"TYPE", "n"}, "+string\r\n"},
+		{[]string{"RPUSH", "l", "a", "b"}, ":2\r\n"},
+		{[]string{"LRANGE", "l", "0", "-1"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"GET", "l"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"nope"}, "-ERR unknown command 'nope'\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"DEL", "n"}, "+QUEUED\r\n"},
+		{[]string{"DEL", "n"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*2\r\n:1\r\n:0\r\n"},
+		// replies follow the commands as sent, not as normalized
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "e", "v", "NX", "EX", "100"}, "+QUEUED\r\n"},
+		{[]string{"SET", "e", "w", "NX"}, "+QUEUED\r\n"},
+		{[]string{"EXPIRE", "e", "100"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*3\r\n+OK\r\n$-1\r\n:1\r\n"},
+	} {
+		if reply, _ := s.respCommand(test.args); reply != test.reply {
+			t.Errorf("%q: expected %q, got %q", test.args, test.reply, reply)
+		}
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nget\r\n$4\r\na b\n\r\nset k  v\r\n*0\r\n*1\r\n$0\r\n\r\n"))
+	for _, want := range [][]string{{"get", "a b\n"}, {"set", "k", "v"}, nil, {""}} {
+		if args, err := readRESP(r); err != nil || fmt.Sprint(args) != fmt.Sprint(want) || len(args) != len(want) {
+			t.Errorf("expected %q, got %q, %v", want, args, err)
+		}
+	}
+	if _, err := readRESP(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	for _, request := range []string{
+		"*x\r\n",
+		"*1\r\n+get\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$3\r\ngetx\r\n",
+		fmt.Sprintf("*%d\r\n", RESP_MAX_ARGS+1),
+		fmt.Sprintf("*1\r\n$%d\r\n", frameLimit()+1),
+	} {
+		if _, err := readRESP(bufio.NewReader(strings.NewReader(request))); err != errRESPProtocol {
+			t.Errorf("%q: expected a protocol error, got %v", request, err)
+		}
+	}
+	if _, err := readRESP(bufio.NewReader(strings.NewReader("*2\r\n$3\r\nget\r\n"))); err != io.EOF {
+		t.Errorf("truncated request: expected EOF, got %v", err)
+	}
+
+	// the arguments of a request together must fit in maxframe
+	defer maxFrame.Set(maxFrame.String())
+	maxFrame.Set("10")
+	if _, err := readRESP(bufio.NewReader(strings.NewReader("*2\r\n$6\r\nabcdef\r\n$6\r\nabcdef\r\n"))); err != errRESPProtocol {
+		t.Errorf("request over maxframe: expected a protocol error, got %v", err)
+	}
+	if args, err := readRESP(bufio.NewReader(strings.NewReader("*2\r\n$5\r\nabcde\r\n$5\r\nabcde\r\n"))); len(args) != 2 || err != nil {
+		t.Errorf("request of maxframe: expected 2 arguments, got %q, %v", args, err)
+	}
+	for _, request := range []string{"set k abcdefghijk\r\n", "*1\r\n$" + strings.Repeat("0", 20)} {
+		if _, err := readRESP(bufio.NewReader(strings.NewReader(request))); err != errRESPProtocol {
+			t.Errorf("%q: expected a protocol error for a line over maxframe, got %v", request, err)
+		}
+	}
+}
+
+func TestRESPDisconnect(t *testing.T) {
+	d, _, _ := testServer(t)
+	client, server := net.Pipe()
+	exited := make(chan struct{})
+	go func() {
+		handleRESPClient(server)
+		close(exited)
+	}()
+
+	io.WriteString(client, "*3\r\n$5\r\nBLPOP\r\n$1\r\nq\r\n$1\r\n0\r\n")
+	blocked := func() int {
+		unlock := d.lock([]string{"q"}, false)
+		defer unlock()
+		return len(d.shardOf("q").blocked)
+	}
+	for start := time.Now(); blocked() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("blpop did not block")
+		}
+	}
+	client.Close()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("The session of a disconnected client kept waiting")
+	}
+	if n := blocked(); n != 0 {
+		t.Errorf("%d keys still blocked on", n)
+	}
+
+	// a job pushed afterwards is not popped for the closed connection
+	s := &Session{db: d}
+	s.GoSQL("rpush q job")
+	if r, _ := s.GoSQL("lrange q 0 -1"); r != "L3:job" {
+		t.Errorf("lrange after disconnect: expected %q, got %q", "L3:job", r)
+	}
+}
+
+func TestPoolState(t *testing.T) {
+	_, addr, _ := testServer(t)
+	p := godb.NewPool(addr, 1, 1)
+	defer p.Close()
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name  string
+		use   func(g *godb.Godb) error
+		reuse bool
+	}{
+		{"open transaction", func(g *godb.Godb) error { _, err := g.Begin(); return err }, false},
+		{"watch", func(g *godb.Godb) error { return g.Watch("k") }, false},
+		{"raw subscribe", func(g *godb.Godb) error { _, err := g.Do("subscribe c"); return err }, false},
+		{"raw use", func(g *godb.Godb) error { _, err := g.Do("use " + DEFAULT_DB); return err }, false},
+		{"raw auth", func(g *godb.Godb) error { _, err := g.Do("auth someone pw"); return err }, false},
+		{"auth as another user", func(g *godb.Godb) error { return g.Auth("someone", "pw") }, false},
+		{"set", func(g *godb.Godb) error { return g.Set("k", "v") }, true},
+		{"committed transaction", func(g *godb.Godb) error {
+			if err := g.Watch("k"); err != nil {
+				return err
+			}
+			tx, err := g.Begin()
+			if err == nil {
+				_, err = tx.Commit()
+			}
+			return err
+		}, true},
+		{"rolled back transaction", func(g *godb.Godb) error {
+			tx, err := g.Begin()
+			if err == nil {
+				err = tx.Rollback()
+			}
+			return err
+		}, true},
+	} {
+		g, err := p.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.use(g); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		p.Put(g)
+		if reused := p.Stats().Idle == 1; reused != test.reuse {
+			t.Errorf("%s: expected the connection to be reused: %v, got %v", test.name, test.reuse, reused)
+		}
+		// the next connection starts without a transaction
+		if err := p.Set("k", "v"); err != nil {
+			t.Errorf("after %s: %v", test.name, err)
+		}
+	}
+}
+
+// Writes a certificate authority and a server and a client certificate signed by it to dir,
+// as PEM files named ca.pem, server.pem, server.key, client.pem and client.key.
+// The server certificate is valid for 127.0.0.1 and localhost.
+func writeTestCerts(t *testing.T, dir string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "godb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+
+	for i, name := range []string{"server", "client"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    ca.NotBefore,
+			NotAfter:     ca.NotAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}
+		if name == "server" {
+			cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			cert.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+			cert.DNSNames = []string{"localhost"}
+		} else {
+			cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+		writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	}
+}
+
+func writePEM(t *testing.T, name, kind string, der []byte) {
+	if err := ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+
+	*tlsCert, *tlsKey = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	*tlsCA, *tlsClientAuth = filepath.Join(dir, "ca.pem"), "require"
+	defer func() {
+		*tlsCert, *tlsKey, *tlsCA, *tlsClientAuth = "", "", "", "none"
+		serverTLS = nil
+	}()
+	if serverTLS, err = tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	_, addr, _ := testServer(t)
+
+	roots := x509.NewCertPool()
+	caPEM, _ := ioutil.ReadFile(*tlsCA)
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	g, err := godb.Dial(ctx, addr, godb.WithTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}))
+	if err != nil {
+		t.Fatal("Dial with a client certificate:", err)
+	}
+	defer g.Close()
+	if err := g.Set("tls", "yes"); err != nil {
+		t.Error("Set over TLS:", err)
+	}
+	if v, err := g.Get("tls"); v != "yes" || err != nil {
+		t.Error("Get over TLS returned", v, err)
+	}
+
+	if g, err := godb.Dial(ctx, addr, godb.WithTLS(&tls.Config{RootCAs: roots})); err == nil {
+		g.Close()
+		t.Error("Connected without a client certificate")
+	}
+	if g, err := godb.Dial(ctx, addr, godb.WithTLS(&tls.Config{Certificates: []tls.Certificate{clientCert}})); err == nil {
+		g.Close()
+		t.Error("Connected to a server signed by an unknown authority")
+	}
+	if g, err := godb.Dial(ctx, addr, godb.WithDialTimeout(time.Second)); err == nil {
+		g.Close()
+		t.Error("Connected without TLS")
+	}
+}
+
+func TestACL(t *testing.T) {
+	if h := hashPassword("secret"); !checkPassword(h, "secret") || checkPassword(h, "Secret") {
+		t.Error("Password hash does not check out:", h)
+	}
+
+	dir, err := ioutil.TempDir("", "godb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// hashes with few iterations keep the test fast
+	hash := func(password string) string {
+		key, _ := pbkdf2.Key(sha256.New, password, []byte("salt"), 10, PASSWORD_KEY_SIZE)
+		return fmt.Sprintf("%s$10$%s$%s", PASSWORD_SCHEME,
+			base64.RawStdEncoding.EncodeToString([]byte("salt")), base64.RawStdEncoding.EncodeToString(key))
+	}
+	name := filepath.Join(dir, "users")
+	ioutil.WriteFile(name, []byte(fmt.Sprintf("# name hash access prefixes\nroot %s admin\napp %s write @appdb app:\n\nro %s read app: pub:\n",
+		hash("rootpw"), hash("apppw"), hash("ropw"))), 0600)
+	if users, err = loadUsers(name); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { users = nil }()
+
+	s := &Session{db: newDB("acl")}
+	for _, test := range [][2]string{
+		{"get app:x", "-U"},
+		{"nosuchcommand", "-U"},
+		{"auth app wrong", "-U"},
+		{"auth nobody apppw", "-U"},
+		{"get app:x", "-U"},
+		{"auth app apppw", "1"},
+		{"set app:x 1", "1"},
+		{"set other 1", "-D"},
+		{"copy app:x other", "-D"},
+		{"rename app:x app:y", "1"},
+		{"keys app:*", "L5:app:y"},
+		{"keys *", "-D"},
+		{"scan 0 match app:y*", "L1:05:app:y"},
+		{"scan 0", "-D"},
+		{"dbsize", "-D"},
+		{"range app:a app:z", "L5:app:y1:1"},
+		{"range a z", "-D"},
+		{"prefix app:", "L5:app:y1:1"},
+		{"watchkeys other", "-D"},
+		{"blpop app:q other 1", "-D"},
+		{"shutdown", "-D"},
+		{"config get *", "-D"},
+		{"use other", "-D"},
+		{"set", "-A"},
+		{"multi", "1"},
+		{"set other 1", "-D"},
+		{"discard", "1"},
+		{"auth ro ropw", "1"},
+		{"get app:y", "R1"},
+		{"set app:y 2", "-D"},
+		{"publish ch m", "-D"},
+		{"get pub:a", "-K"},
+		{"auth root rootpw", "1"},
+		{"set other 1", "1"},
+		{"dbsize", "R2"},
+	} {
+		if r, _ := s.GoSQL(test[0]); r != test[1] {
+			t.Errorf("%s: expected %q, got %q", test[0], test[1], r)
+		}
+	}
+
+	// databases are opened or created by use only for users allowed to
+	for _, test := range []struct {
+		user, db, response string
+	}{
+		{"app", DEFAULT_DB, APPLIED},
+		{"app", "appdb", APPLIED},
+		{"app", "other", "-D"},
+		{"ro", "appdb", "-D"},
+		{"root", "other", APPLIED},
+	} {
+		s.user = users[test.user]
+		if r := s.authorize("use", []string{"use", test.db}); r != test.response {
+			t.Errorf("%s using %s: expected %q, got %q", test.user, test.db, test.response, r)
+		}
+	}
+
+	// RESP clients only get data echoed by ping once authenticated
+	s = &Session{db: newDB("acl")}
+	for _, test := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"PING", "hi"}, "-NOAUTH Authentication required.\r\n"},
+		{[]string{"AUTH", "ro", "ropw"}, "+OK\r\n"},
+		{[]string{"PING", "hi"}, "$2\r\nhi\r\n"},
+	} {
+		if reply, _ := s.respCommand(test.args); reply != test.reply {
+			t.Errorf("%q: expected %q, got %q", test.args, test.reply, reply)
+		}
+	}
+
+	for _, line := range []string{"root " + hash("rootpw") + " superuser", "app " + hash("apppw") + " write @a.b"} {
+		ioutil.WriteFile(name, []byte(line+"\n"), 0600)
+		if _, err := loadUsers(name); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Error("Expected an error on line 1, got", err)
+		}
+	}
+}
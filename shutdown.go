@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Time given to clients to finish the commands they are running when the server shuts down.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+var (
+	listeners []net.Listener
+	clients   = make(map[net.Conn]bool) // Open client connections
+	stopping  bool                      // Set once the server started shutting down
+	clientsMu sync.Mutex                // To protect the variables above
+
+	handlers     sync.WaitGroup // Running client handlers
+	shutdownOnce sync.Once
+)
+
+// Listens on a TCP address, over TLS if serverTLS is set. The listener is closed when the
+// server shuts down.
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	listeners = append(listeners, listener)
+	return listener, nil
+}
+
+// Accepts connections until the server shuts down, running handle for each in a goroutine of its own.
+// Connections beyond the maxclients setting are passed to reject instead, which tells the client
+// why before they are closed.
+func serve(listener net.Listener, handle, reject func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		clientsMu.Lock()
+		if stopping {
+			clientsMu.Unlock()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			clientsMu.Unlock()
+			continue
+		}
+		if maxClients.exceeded(len(clients) + 1) {
+			clientsMu.Unlock()
+			logf(LOG_WARNING, "Rejected %s: too many clients\n", conn.RemoteAddr())
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+				reject(conn)
+			}()
+			continue
+		}
+		clients[conn] = true
+		handlers.Add(1)
+		clientsMu.Unlock()
+		logf(LOG_DEBUG, "Accepted %s\n", conn.RemoteAddr())
+
+		go func() {
+			defer handlers.Done()
+			defer func() {
+				clientsMu.Lock()
+				delete(clients, conn)
+				clientsMu.Unlock()
+				logf(LOG_DEBUG, "Closed %s\n", conn.RemoteAddr())
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// Shuts the server down on SIGINT and SIGTERM.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	logf(LOG_INFO, "Received %s, shutting down\n", sig)
+	shutdown(true)
+}
+
+// Stops accepting connections, lets clients finish the commands they are running for up to
+// SHUTDOWN_TIMEOUT, writes a snapshot of every open database if save is set and exits.
+// Without save nothing is lost either: the next start replays the write-ahead logs.
+//
+// Idle connections are closed by making their pending read fail. A client waiting in a
+// blocking command gets NOT_APPLIED, as if it had timed out.
+func shutdown(save bool) {
+	shutdownOnce.Do(func() {
+		clientsMu.Lock()
+		stopping = true
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		for conn := range clients {
+			conn.SetReadDeadline(time.Now())
+		}
+		clientsMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			handlers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(SHUTDOWN_TIMEOUT):
+			logf(LOG_WARNING, "Some clients did not finish in time\n")
+		}
+
+		status := 0
+		for _, d := range openDBs() {
+			// commands and snapshots still running finish first and none start after
+			d.saving.Lock()
+			d.rlockAll()
+			if save && atomic.LoadInt64(&d.dirty) > 0 {
+				err := d.SaveDB()
+				if err == nil {
+					err = d.discardSaved(d.wal.Seq())
+				}
+				if err != nil {
+					logf(LOG_ERROR, "Could not save %s: %s\n", d.name, err.Error())
+					status = 1
+				}
+			}
+			d.wal.Close()
+		}
+		os.Exit(status)
+	})
+}
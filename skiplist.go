@@ -0,0 +1,115 @@
+package main
+
+// Maximum number of levels of a skiplist, enough for 4^16 keys at the probability below.
+const SKIPLIST_LEVELS = 16
+
+// A skiplist keeps the keys of a shard in order, so that ranges of keys can be read without
+// sorting the whole shard. Values stay in the shard's map.
+type skiplist struct {
+	head  skipNode // Sentinel before the first key
+	tail  *skipNode
+	level int    // Number of levels in use
+	seed  uint64 // State of the level generator
+}
+
+type skipNode struct {
+	key  string
+	prev *skipNode // nil for the first key
+	next []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  skipNode{next: make([]*skipNode, SKIPLIST_LEVELS)},
+		level: 1,
+		seed:  0x9e3779b97f4a7c15,
+	}
+}
+
+// Returns a random level, each level being a quarter as likely as the one below.
+func (l *skiplist) randomLevel() int {
+	// xorshift64
+	l.seed ^= l.seed << 13
+	l.seed ^= l.seed >> 7
+	l.seed ^= l.seed << 17
+	level := 1
+	for r := l.seed; level < SKIPLIST_LEVELS && r&3 == 0; r >>= 2 {
+		level++
+	}
+	return level
+}
+
+// Finds the last node before key on every level.
+func (l *skiplist) predecessors(key string) (update [SKIPLIST_LEVELS]*skipNode) {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	for i := l.level; i < SKIPLIST_LEVELS; i++ {
+		update[i] = &l.head
+	}
+	return
+}
+
+// Adds a key that is not in the list.
+func (l *skiplist) insert(key string) {
+	update := l.predecessors(key)
+	level := l.randomLevel()
+	if level > l.level {
+		l.level = level
+	}
+	n := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	if update[0] != &l.head {
+		n.prev = update[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		l.tail = n
+	}
+}
+
+// Removes a key if it is in the list.
+func (l *skiplist) delete(key string) {
+	update := l.predecessors(key)
+	n := update[0].next[0]
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		update[i].next[i] = n.next[i]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	} else {
+		l.tail = n.prev
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// Returns the first node with a key greater than or equal to key, or nil.
+func (l *skiplist) seek(key string) *skipNode {
+	return l.predecessors(key)[0].next[0]
+}
+
+// Returns the last node with a key less than key, or nil. An empty key means no bound,
+// returning the last node.
+func (l *skiplist) seekBefore(key string) *skipNode {
+	if key == "" {
+		return l.tail
+	}
+	n := l.predecessors(key)[0]
+	if n == &l.head {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	SNAPSHOT_MAGIC   = "GDBS"
+	SNAPSHOT_VERSION = 2 // Version 2 added hashes, lists and sets
+
+	// Magic, format version, body length and CRC-32 of the body.
+	SNAPSHOT_HEADER_SIZE = 4 + 4 + 8 + 4
+
+	// Suffix of the snapshot kept from before the last SaveDB.
+	SNAPSHOT_PREV = ".prev"
+)
+
+var (
+	errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	errSnapshotSize     = errors.New("snapshot is truncated")
+)
+
+// Contents of the snapshot file.
+type Snapshot struct {
+	// Sequence number of the last write-ahead log record included in Data
+	Seq uint64
+
+	Data map[string]string
+
+	// Keys holding other types of values
+	Hashes map[string]map[string]string
+	Lists  map[string][]string
+	Sets   map[string][]string
+
+	// Expiry deadlines of keys, in Unix milliseconds
+	Expires map[string]int64
+}
+
+// Loads the map of the database from its snapshot file and returns the sequence number of the
+// last write-ahead log record it contains.
+// If the snapshot file is corrupt the previous snapshot is used instead.
+// An error is returned only if snapshot files exist but none of them can be read.
+func (d *DB) LoadDB() (seq uint64, err error) {
+	snap, err := readSnapshot(d.file)
+	if os.IsNotExist(err) {
+		// a crash between the two renames in SaveDB leaves only the previous snapshot
+		snap, err = readSnapshot(d.file + SNAPSHOT_PREV)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+	} else if err != nil {
+		logf(LOG_WARNING, "Rejected snapshot %s: %s\n", d.file, err.Error())
+		snap, err = readSnapshot(d.file + SNAPSHOT_PREV)
+		if err == nil {
+			logf(LOG_WARNING, "Using previous snapshot %s\n", d.file+SNAPSHOT_PREV)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("no usable snapshot for %s: %s", d.name, err.Error())
+	}
+	d.setContents(snap)
+	d.snapSeq = snap.Seq
+	return snap.Seq, nil
+}
+
+// Writes the map of the database to its snapshot file along with the current write-ahead log position.
+// The caller must hold the locks of all shards.
+func (d *DB) SaveDB() error {
+	snap := d.contents()
+	if d.wal != nil {
+		snap.Seq = d.wal.Seq()
+	}
+	return writeSnapshot(d.file, snap)
+}
+
+// Writes the snapshot to a temporary file, syncs it and renames it into place.
+// The file being replaced is kept with the SNAPSHOT_PREV suffix.
+func writeSnapshot(name string, snap *Snapshot) (err error) {
+	body := new(bytes.Buffer)
+	if err = gob.NewEncoder(body).Encode(snap); err != nil {
+		return
+	}
+	header := make([]byte, SNAPSHOT_HEADER_SIZE)
+	copy(header, SNAPSHOT_MAGIC)
+	binary.BigEndian.PutUint32(header[4:8], SNAPSHOT_VERSION)
+	binary.BigEndian.PutUint64(header[8:16], uint64(body.Len()))
+	binary.BigEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(body.Bytes()))
+
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(header); err != nil {
+		return
+	}
+	if _, err = f.Write(body.Bytes()); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(name, name+SNAPSHOT_PREV); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = os.Rename(f.Name(), name); err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// Reads and verifies a snapshot file.
+// Files without a header are from before versioned snapshots and are decoded as they are.
+func readSnapshot(name string) (snap *Snapshot, err error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	snap = &Snapshot{}
+	if !bytes.HasPrefix(buf, []byte(SNAPSHOT_MAGIC)) {
+		err = decodeLegacySnapshot(buf, snap)
+		return
+	}
+	if len(buf) < SNAPSHOT_HEADER_SIZE {
+		return nil, errSnapshotSize
+	}
+	version := binary.BigEndian.Uint32(buf[4:8])
+	size := binary.BigEndian.Uint64(buf[8:16])
+	sum := binary.BigEndian.Uint32(buf[16:20])
+	if version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	body := buf[SNAPSHOT_HEADER_SIZE:]
+	if uint64(len(body)) != size {
+		return nil, errSnapshotSize
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errSnapshotChecksum
+	}
+	if err = gob.NewDecoder(bytes.NewReader(body)).Decode(snap); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Decodes a snapshot without a header: either a bare gob encoded map or a gob encoded Snapshot.
+func decodeLegacySnapshot(buf []byte, snap *Snapshot) error {
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(snap); err == nil {
+		return nil
+	}
+	snap.Seq = 0
+	snap.Data = make(map[string]string)
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(&snap.Data)
+}
+
+// Makes renames in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Number of partitions of the key space of a database. Each has its own lock.
+const SHARDS = 64
+
+// A shard holds the keys of a database that hash to it.
+type shard struct {
+	mu      sync.RWMutex // To protect the maps below
+	data    map[string]string
+	objects map[string]interface{} // Keys holding a hash, list or set (see types.go)
+	index   *skiplist              // Keys of data and objects in order
+	expires map[string]int64       // Expiry deadlines of keys, in Unix milliseconds
+
+	versions map[string]uint64          // Number of writes to watched keys since they were first watched
+	watchers map[string]int             // Number of sessions watching a key
+	blocked  map[string][]chan struct{} // Sessions waiting for a key to be written, see blockingCommand
+
+	cow map[string]saved // Values of keys before their first write since a checkpoint began, nil otherwise
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, SHARDS)
+	for i := range shards {
+		shards[i] = &shard{
+			data:     make(map[string]string),
+			objects:  make(map[string]interface{}),
+			index:    newSkiplist(),
+			expires:  make(map[string]int64),
+			versions: make(map[string]uint64),
+			watchers: make(map[string]int),
+			blocked:  make(map[string][]chan struct{}),
+		}
+	}
+	return shards
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % SHARDS)
+}
+
+func (d *DB) shardOf(key string) *shard {
+	return d.shards[shardIndex(key)]
+}
+
+// Locks the shards holding the given keys, for writing if write is set and for reading otherwise.
+// Shards are always locked in index order so that commands on several keys can't deadlock.
+// Returns a function that unlocks them.
+func (d *DB) lock(keys []string, write bool) (unlock func()) {
+	var idx []int
+	for _, key := range keys {
+		i := shardIndex(key)
+		dup := false
+		for _, j := range idx {
+			dup = dup || i == j
+		}
+		if !dup {
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		if write {
+			d.shards[i].mu.Lock()
+		} else {
+			d.shards[i].mu.RLock()
+		}
+	}
+	return func() {
+		for j := len(idx) - 1; j >= 0; j-- {
+			if write {
+				d.shards[idx[j]].mu.Unlock()
+			} else {
+				d.shards[idx[j]].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// Read locks every shard, which stops all writes to the database. Used for snapshots.
+func (d *DB) rlockAll() (unlock func()) {
+	for _, s := range d.shards {
+		s.mu.RLock()
+	}
+	return func() {
+		for i := len(d.shards) - 1; i >= 0; i-- {
+			d.shards[i].mu.RUnlock()
+		}
+	}
+}
+
+// The accessors below require the shard of the key to be locked, for writing if they modify it.
+
+// Returns the value of a key holding a string. Keys past their deadline are reported as not set;
+// they are deleted by the sweeper or overwritten by the next write.
+func (d *DB) lookup(key string) (v string, ok bool) {
+	s := d.shardOf(key)
+	if deadline, ok := s.expires[key]; ok && deadline <= d.now() {
+		return "", false
+	}
+	v, ok = s.data[key]
+	return
+}
+
+// Returns the hash, list or set held by a key.
+func (d *DB) object(key string) (obj interface{}, ok bool) {
+	s := d.shardOf(key)
+	if deadline, ok := s.expires[key]; ok && deadline <= d.now() {
+		return nil, false
+	}
+	obj, ok = s.objects[key]
+	return
+}
+
+// Returns the value of a key of any type: a string or a hash, list or set.
+func (d *DB) value(key string) (v interface{}, ok bool) {
+	if v, ok := d.lookup(key); ok {
+		return v, true
+	}
+	return d.object(key)
+}
+
+// Sets a key to a value returned by value, leaving its deadline unchanged.
+func (d *DB) storeValue(key string, v interface{}) {
+	if s, ok := v.(string); ok {
+		d.store(key, s)
+	} else {
+		d.storeObject(key, v)
+	}
+}
+
+// Reports whether a key is set, whatever the type of its value.
+func (d *DB) exists(key string) bool {
+	return d.typeOf(key) != TYPE_NONE
+}
+
+// Sets a key to a string, replacing a value of any type and leaving its deadline unchanged.
+func (d *DB) store(key, v string) {
+	d.preserve(key)
+	s := d.shardOf(key)
+	if _, ok := s.objects[key]; ok {
+		delete(s.objects, key)
+	} else if _, ok := s.data[key]; !ok {
+		s.index.insert(key)
+	}
+	s.data[key] = v
+	d.touch(key)
+}
+
+// Sets a key to a hash, list or set, replacing a value of any type and leaving its deadline unchanged.
+func (d *DB) storeObject(key string, obj interface{}) {
+	d.preserve(key)
+	s := d.shardOf(key)
+	if _, ok := s.data[key]; ok {
+		delete(s.data, key)
+	} else if _, ok := s.objects[key]; !ok {
+		s.index.insert(key)
+	}
+	s.objects[key] = obj
+	d.touch(key)
+}
+
+// Deletes a key and its deadline.
+func (d *DB) remove(key string) {
+	d.preserve(key)
+	s := d.shardOf(key)
+	_, isString := s.data[key]
+	_, isObject := s.objects[key]
+	if isString || isObject {
+		s.index.delete(key)
+	}
+	delete(s.data, key)
+	delete(s.objects, key)
+	delete(s.expires, key)
+	d.touch(key)
+}
+
+func (d *DB) deadline(key string) (t int64, ok bool) {
+	t, ok = d.shardOf(key).expires[key]
+	return
+}
+
+func (d *DB) setDeadline(key string, t int64) {
+	d.preserve(key)
+	d.shardOf(key).expires[key] = t
+	d.touch(key)
+}
+
+func (d *DB) clearDeadline(key string) {
+	d.preserve(key)
+	delete(d.shardOf(key).expires, key)
+	d.touch(key)
+}
+
+// Returns a copy of all keys and deadlines. Requires all shards to be locked.
+func (d *DB) contents() *Snapshot {
+	snap := newSnapshot()
+	for _, s := range d.shards {
+		for k, v := range s.data {
+			snap.add(k, v)
+		}
+		for k, obj := range s.objects {
+			snap.add(k, obj)
+		}
+		for k, t := range s.expires {
+			snap.Expires[k] = t
+		}
+	}
+	return snap
+}
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{
+		Data:    make(map[string]string),
+		Expires: make(map[string]int64),
+		Hashes:  make(map[string]map[string]string),
+		Lists:   make(map[string][]string),
+		Sets:    make(map[string][]string),
+	}
+}
+
+// Adds a copy of a value returned by value to the snapshot.
+func (snap *Snapshot) add(key string, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		snap.Data[key] = v
+	case hash:
+		snap.Hashes[key] = cloneObject(v).(hash)
+	case *list:
+		snap.Lists[key] = append([]string(nil), v.items...)
+	case set:
+		snap.Sets[key] = v.members()
+	}
+}
+
+// Replaces the contents of the database. Used when loading a snapshot.
+func (d *DB) setContents(snap *Snapshot) {
+	d.shards = newShards()
+	for k, v := range snap.Data {
+		d.store(k, v)
+	}
+	for k, fields := range snap.Hashes {
+		d.storeObject(k, hash(fields))
+	}
+	for k, items := range snap.Lists {
+		d.storeObject(k, &list{items})
+	}
+	for k, members := range snap.Sets {
+		st := make(set)
+		for _, m := range members {
+			st[m] = struct{}{}
+		}
+		d.storeObject(k, st)
+	}
+	for k, t := range snap.Expires {
+		d.setDeadline(k, t)
+	}
+}
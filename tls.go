@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+)
+
+var (
+	tlsCert = flag.String("tlscert", "", "PEM certificate file of the server. Clients are served over TLS if it is set, with tlskey.")
+	tlsKey  = flag.String("tlskey", "", "PEM private key file of tlscert.")
+	tlsCA   = flag.String("tlsca", "", "PEM file of the certificate authorities that sign client certificates.")
+
+	tlsClientAuth = flag.String("tlsclientauth", "none",
+		"Client certificates asked for over TLS: none, optional (verified against tlsca if sent) or require.")
+)
+
+var serverTLS *tls.Config // Used by listen, nil without TLS
+
+var (
+	errTLSKeyPair    = errors.New("tlscert and tlskey must be set together")
+	errTLSCA         = errors.New("no certificate found in tlsca")
+	errTLSClientAuth = errors.New("tlsclientauth must be none, optional or require, and needs tlsca unless none")
+)
+
+// Builds the TLS configuration of the listeners from the tls* settings.
+// Returns nil if tlscert is not set.
+func tlsConfig() (*tls.Config, error) {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, errTLSKeyPair
+	}
+	if *tlsCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errTLSCA
+		}
+	}
+	switch *tlsClientAuth {
+	case "none":
+		config.ClientAuth = tls.NoClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errTLSClientAuth
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, errTLSClientAuth
+	}
+	return config, nil
+}
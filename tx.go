@@ -0,0 +1,269 @@
+package main
+
+import (
+	"github.com/marella/godb/wire"
+	"strings"
+)
+
+// Commands that start, end or prepare a transaction. They are handled by the session.
+var txCommands = map[string]bool{
+	"begin":    true,
+	"multi":    true,
+	"commit":   true,
+	"exec":     true,
+	"rollback": true,
+	"discard":  true,
+	"watch":    true,
+	"unwatch":  true,
+}
+
+// A transaction being queued by a session between begin and commit.
+type Tx struct {
+	queue  []queued
+	failed bool // A command could not be queued, so commit will abort
+}
+
+// A command of a transaction. It is normalized by commit rather than when queued, so that
+// relative deadlines count from when the transaction runs.
+type queued struct {
+	args []string                        // As the client sent them
+	norm func([]string) ([]string, bool) // See runCommand
+}
+
+// A key watched by a session. The transaction is aborted at commit if the key has been
+// written since, or has appeared or disappeared.
+type watch struct {
+	key     string
+	version uint64
+	exists  bool
+}
+
+// Saved state of a key, used to roll back a transaction.
+type saved struct {
+	key         string
+	v           string
+	ok          bool
+	obj         interface{} // Copy of the hash, list or set of the key
+	deadline    int64
+	hasDeadline bool
+	version     uint64 // Watch version, restored so that a rollback does not abort other transactions
+	watched     bool
+}
+
+// Runs begin/multi, commit/exec, rollback/discard, watch and unwatch.
+func (s *Session) txCommand(cmd string, args []string) (response string) {
+	response = "1"
+	switch cmd {
+	case "begin", "multi":
+		if s.tx != nil {
+			return "-T"
+		}
+		s.tx = &Tx{}
+
+	case "commit", "exec":
+		if s.tx == nil {
+			return "-T"
+		}
+		tx := s.tx
+		s.tx = nil
+		defer s.unwatch()
+		if tx.failed {
+			return "-X"
+		}
+		return s.db.commit(tx.queue, s.watches)
+
+	case "rollback", "discard":
+		if s.tx == nil {
+			return "-T"
+		}
+		s.tx = nil
+		s.unwatch()
+
+	case "watch":
+		if s.tx != nil {
+			return "-T"
+		}
+		for _, key := range args[1:] {
+			s.watches = append(s.watches, s.db.watch(key))
+		}
+
+	case "unwatch":
+		s.unwatch()
+	}
+	return
+}
+
+// Adds a command to the transaction of the session.
+func (s *Session) queue(cmd string, args []string, norm func([]string) ([]string, bool)) string {
+	if cmd == "quit" || cmd == "use" || selfLocking[cmd] {
+		s.tx.failed = true
+		return "-T"
+	}
+	s.tx.queue = append(s.tx.queue, queued{args, norm})
+	return "Q"
+}
+
+func (s *Session) unwatch() {
+	for _, w := range s.watches {
+		s.db.unwatch(w.key)
+	}
+	s.watches = nil
+}
+
+// Starts watching a key for changes.
+func (d *DB) watch(key string) watch {
+	unlock := d.lock([]string{key}, true)
+	defer unlock()
+	sh := d.shardOf(key)
+	if sh.watchers[key] == 0 {
+		sh.versions[key] = 0
+	}
+	sh.watchers[key]++
+	_, exists := d.lookup(key)
+	return watch{key, sh.versions[key], exists}
+}
+
+func (d *DB) unwatch(key string) {
+	unlock := d.lock([]string{key}, true)
+	defer unlock()
+	sh := d.shardOf(key)
+	if sh.watchers[key]--; sh.watchers[key] <= 0 {
+		delete(sh.watchers, key)
+		delete(sh.versions, key)
+	}
+}
+
+// Records a write to a key for the sessions watching it and wakes up the sessions waiting for it.
+// The caller must hold the write lock of the shard of the key.
+func (d *DB) touch(key string) {
+	sh := d.shardOf(key)
+	if _, ok := sh.versions[key]; ok {
+		sh.versions[key]++
+	}
+	for _, wake := range sh.blocked[key] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Runs the queued commands of a transaction while holding the write locks of all the keys
+// they use, so no other client sees or interleaves with a partial transaction.
+// If a watched key has changed nothing is run and "-X" is returned. If a command fails
+// the transaction is rolled back and the error of that command is returned.
+// Otherwise the mutating commands are written to the log as a single record and the
+// responses of all commands are returned as a list.
+func (d *DB) commit(queue []queued, watches []watch) string {
+	var keys []string
+	for _, q := range queue {
+		keys = append(keys, commandKeys(strings.ToLower(q.args[0]), q.args)...)
+	}
+	for _, w := range watches {
+		keys = append(keys, w.key)
+	}
+	unlock := d.lock(keys, true)
+	defer unlock()
+
+	for _, w := range watches {
+		_, exists := d.lookup(w.key)
+		if d.shardOf(w.key).versions[w.key] != w.version || exists != w.exists {
+			return "-X"
+		}
+	}
+
+	cmds := make([][]string, len(queue))
+	for i, q := range queue {
+		args, ok := q.norm(q.args)
+		if !ok {
+			// checked when queued
+			return "-A"
+		}
+		cmds[i] = args
+	}
+
+	state := d.save(keys)
+	responses := make([]string, len(queue))
+	var logged [][]string
+	for i, args := range cmds {
+		cmd := strings.ToLower(args[0])
+		r, _ := d.execute(args)
+		if mutating[cmd] {
+			if strings.HasPrefix(r, "-") {
+				d.restore(state)
+				return r
+			}
+			logged = append(logged, args)
+		}
+		responses[i] = r
+	}
+
+	if len(logged) > 0 && d.wal != nil {
+		if err := d.wal.Append(stamp(txRecord(logged))); err != nil {
+			logf(LOG_ERROR, "WAL: %s\n", err.Error())
+			d.restore(state)
+			return "-W"
+		}
+	}
+	for i, args := range cmds {
+		d.written(args, responses[i])
+	}
+	return wire.EncodeList(responses)
+}
+
+// Encodes the commands of a transaction as the arguments of a single "txn" log record.
+func txRecord(cmds [][]string) []string {
+	record := []string{"txn"}
+	for _, args := range cmds {
+		record = append(record, string(encodeArgs(args)))
+	}
+	return record
+}
+
+// Applies a "txn" log record while replaying the write-ahead log.
+func (d *DB) replayTx(record []string) {
+	for _, arg := range record[1:] {
+		args, err := decodeArgs([]byte(arg))
+		if err != nil || len(args) == 0 {
+			continue
+		}
+		d.execute(args)
+	}
+}
+
+// Saves the values and deadlines of keys, including expired ones.
+func (d *DB) save(keys []string) []saved {
+	state := make([]saved, len(keys))
+	for i, key := range keys {
+		sh := d.shardOf(key)
+		state[i].key = key
+		state[i].v, state[i].ok = sh.data[key]
+		if obj, ok := sh.objects[key]; ok {
+			state[i].obj = cloneObject(obj)
+		}
+		state[i].deadline, state[i].hasDeadline = sh.expires[key]
+		state[i].version, state[i].watched = sh.versions[key]
+	}
+	return state
+}
+
+// Puts back the values, deadlines and watch versions saved by save.
+func (d *DB) restore(state []saved) {
+	for _, st := range state {
+		d.remove(st.key)
+		if st.ok {
+			d.store(st.key, st.v)
+		} else if st.obj != nil {
+			d.storeObject(st.key, st.obj)
+		}
+		if st.hasDeadline {
+			d.setDeadline(st.key, st.deadline)
+		}
+	}
+	// the keys are back as they were, so the writes above don't count as changes
+	for _, st := range state {
+		if st.watched {
+			d.shardOf(st.key).versions[st.key] = st.version
+		}
+	}
+}
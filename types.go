@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"github.com/marella/godb/wire"
+	"sort"
+	"strconv"
+)
+
+// Types of values, as returned by the type command.
+const (
+	TYPE_NONE   = "none"
+	TYPE_STRING = "string"
+	TYPE_HASH   = "hash"
+	TYPE_LIST   = "list"
+	TYPE_SET    = "set"
+)
+
+// Values of keys that are not strings. They are modified in place under the write lock of
+// their shard. A key whose hash, list or set becomes empty is deleted.
+type (
+	hash map[string]string
+	list struct{ items []string }
+	set  map[string]struct{}
+)
+
+// Type of value each command works on. Running a command on a key holding another type of
+// value fails with "-Y".
+var commandTypes = map[string]string{
+	"cas":         TYPE_STRING,
+	"decr":        TYPE_STRING,
+	"decrby":      TYPE_STRING,
+	"get":         TYPE_STRING,
+	"getset":      TYPE_STRING,
+	"incr":        TYPE_STRING,
+	"incrby":      TYPE_STRING,
+	"incrbyfloat": TYPE_STRING,
+	"hdel":        TYPE_HASH,
+	"hget":        TYPE_HASH,
+	"hgetall":     TYPE_HASH,
+	"hset":        TYPE_HASH,
+	"lpop":        TYPE_LIST,
+	"lpush":       TYPE_LIST,
+	"lrange":      TYPE_LIST,
+	"rpop":        TYPE_LIST,
+	"rpush":       TYPE_LIST,
+	"sadd":        TYPE_SET,
+	"sismember":   TYPE_SET,
+	"smembers":    TYPE_SET,
+	"srem":        TYPE_SET,
+}
+
+// Returns the type of the value of a key, or TYPE_NONE if it is not set.
+func (d *DB) typeOf(key string) string {
+	if _, ok := d.lookup(key); ok {
+		return TYPE_STRING
+	}
+	obj, ok := d.object(key)
+	if !ok {
+		return TYPE_NONE
+	}
+	switch obj.(type) {
+	case hash:
+		return TYPE_HASH
+	case *list:
+		return TYPE_LIST
+	}
+	return TYPE_SET
+}
+
+// Returns a deep copy of a hash, list or set.
+func cloneObject(obj interface{}) interface{} {
+	switch obj := obj.(type) {
+	case hash:
+		h := make(hash, len(obj))
+		for k, v := range obj {
+			h[k] = v
+		}
+		return h
+	case *list:
+		return &list{append([]string(nil), obj.items...)}
+	case set:
+		st := make(set, len(obj))
+		for m := range obj {
+			st[m] = struct{}{}
+		}
+		return st
+	}
+	return obj
+}
+
+// Returns the members of a set, sorted.
+func (st set) members() []string {
+	members := make([]string, 0, len(st))
+	for m := range st {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Returns the hash, list or set of a key for a command that modifies it, creating an empty one
+// (with newObject) if the key is not set. The type has been checked by execute.
+func (d *DB) writable(key string, newObject func() interface{}) interface{} {
+	if obj, ok := d.object(key); ok {
+		return obj
+	}
+	d.remove(key) // of an expired key
+	obj := newObject()
+	d.storeObject(key, obj)
+	return obj
+}
+
+// Deletes a key whose hash, list or set became empty, or records the change.
+func (d *DB) modified(key string, size int) {
+	if size == 0 {
+		d.remove(key)
+	} else {
+		d.touch(key)
+	}
+}
+
+// Runs the commands on hashes, lists and sets:
+//
+//	hset <key> <field> <value> [<field> <value> ...]   ->  number of fields added
+//	hget <key> <field>
+//	hdel <key> <field> [<field> ...]                   ->  number of fields deleted
+//	hgetall <key>                                      ->  fields alternating with values
+//	lpush|rpush <key> <value> [<value> ...]            ->  length of the list
+//	lpop|rpop <key>
+//	lrange <key> <start> <stop>                        ->  items, indexes count from the end if negative
+//	sadd <key> <member> [<member> ...]                 ->  number of members added
+//	srem <key> <member> [<member> ...]                 ->  number of members removed
+//	smembers <key>                                     ->  members, sorted
+//	sismember <key> <member>                           ->  APPLIED or NOT_APPLIED
+//
+// The caller must hold the lock of the shard of the key.
+func (d *DB) collectionCommand(cmd string, args []string) string {
+	key := args[1]
+	if mutating[cmd] {
+		// values are modified in place
+		d.preserve(key)
+	}
+	obj, ok := d.object(key)
+	switch cmd {
+
+	case "hset":
+		if len(args)%2 != 0 {
+			return "-A"
+		}
+		h := d.writable(key, func() interface{} { return make(hash) }).(hash)
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		d.touch(key)
+		return fmt.Sprint("R", added)
+
+	case "hget":
+		if !ok {
+			return "-K"
+		}
+		if v, ok := obj.(hash)[args[2]]; ok {
+			return "R" + v
+		}
+		return "-K"
+
+	case "hdel":
+		if !ok {
+			return "R0"
+		}
+		h, deleted := obj.(hash), 0
+		for _, field := range args[2:] {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				deleted++
+			}
+		}
+		d.modified(key, len(h))
+		return fmt.Sprint("R", deleted)
+
+	case "hgetall":
+		var items []string
+		if ok {
+			h := obj.(hash)
+			fields := make([]string, 0, len(h))
+			for field := range h {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				items = append(items, field, h[field])
+			}
+		}
+		return wire.EncodeList(items)
+
+	case "lpush", "rpush":
+		l := d.writable(key, func() interface{} { return &list{} }).(*list)
+		values := args[2:]
+		if cmd == "lpush" {
+			// each value goes in front of the previous one
+			items := make([]string, 0, len(values)+len(l.items))
+			for i := len(values) - 1; i >= 0; i-- {
+				items = append(items, values[i])
+			}
+			l.items = append(items, l.items...)
+		} else {
+			l.items = append(l.items, values...)
+		}
+		d.touch(key)
+		return fmt.Sprint("R", len(l.items))
+
+	case "lpop", "rpop":
+		if !ok {
+			return "-K"
+		}
+		l := obj.(*list)
+		var v string
+		if cmd == "lpop" {
+			v, l.items = l.items[0], l.items[1:]
+		} else {
+			v, l.items = l.items[len(l.items)-1], l.items[:len(l.items)-1]
+		}
+		d.modified(key, len(l.items))
+		return "R" + v
+
+	case "lrange":
+		start, err1 := strconv.Atoi(args[2])
+		stop, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil {
+			return "-A"
+		}
+		var items []string
+		if ok {
+			items = sublist(obj.(*list).items, start, stop)
+		}
+		return wire.EncodeList(items)
+
+	case "sadd":
+		st := d.writable(key, func() interface{} { return make(set) }).(set)
+		added := 0
+		for _, m := range args[2:] {
+			if _, ok := st[m]; !ok {
+				st[m] = struct{}{}
+				added++
+			}
+		}
+		d.touch(key)
+		return fmt.Sprint("R", added)
+
+	case "srem":
+		if !ok {
+			return "R0"
+		}
+		st, removed := obj.(set), 0
+		for _, m := range args[2:] {
+			if _, ok := st[m]; ok {
+				delete(st, m)
+				removed++
+			}
+		}
+		d.modified(key, len(st))
+		return fmt.Sprint("R", removed)
+
+	case "smembers":
+		if !ok {
+			return wire.EncodeList(nil)
+		}
+		return wire.EncodeList(obj.(set).members())
+
+	case "sismember":
+		if !ok {
+			return NOT_APPLIED
+		}
+		if _, ok := obj.(set)[args[2]]; ok {
+			return APPLIED
+		}
+		return NOT_APPLIED
+	}
+	return "-C"
+}
+
+// Returns the items from start to stop inclusive. Negative indexes count from the end.
+func sublist(items []string, start, stop int) []string {
+	n := len(items)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil
+	}
+	return append([]string(nil), items[start:stop+1]...)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Size of the fixed part of a log record: sequence number, payload length and CRC-32 of the payload.
+	WAL_HEADER_SIZE = 16
+
+	// Records larger than this are treated as corrupt.
+	WAL_MAX_RECORD = 1 << 30
+)
+
+var errCorruptRecord = errors.New("corrupt write-ahead log record")
+
+// A WAL is an append-only write-ahead log of mutating commands.
+// Every record is fsync'd before Append returns, so a command whose reply has been sent
+// survives a crash of the server.
+type WAL struct {
+	name string
+	file *os.File
+	seq  uint64 // Sequence number of the last record written or replayed
+	mu   sync.Mutex
+}
+
+// Opens (or creates) the write-ahead log at the given path.
+func OpenWAL(name string) (w *WAL, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	w = &WAL{name: name, file: f}
+	return
+}
+
+// Sequence number of the last record in the log.
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Appends a command to the log and syncs it to disk.
+func (w *WAL) Append(args []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	payload := encodeArgs(args)
+	rec := make([]byte, WAL_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint64(rec[0:8], w.seq+1)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[12:16], crc32.ChecksumIEEE(payload))
+	copy(rec[WAL_HEADER_SIZE:], payload)
+
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Write(rec); err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// don't leave a partial record in front of the next one
+		w.file.Truncate(offset)
+		w.file.Seek(offset, io.SeekStart)
+		return err
+	}
+	w.seq++
+	return nil
+}
+
+// Reads every record in the log and calls apply for those with a sequence number greater than after.
+// A torn or corrupt record at the tail (left behind by a crash mid-write) is discarded and the log
+// is truncated to the last good record. An error is returned if the log starts past the record
+// following after, as the writes in between are lost.
+func (w *WAL) Replay(after uint64, apply func(args []string)) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	r := bufio.NewReader(w.file)
+	var offset int64
+	w.seq = after
+	for {
+		seq, args, n, e := readRecord(r)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			logf(LOG_WARNING, "WAL: discarding tail at offset %d: %s\n", offset, e.Error())
+			if err = w.file.Truncate(offset); err != nil {
+				return
+			}
+			break
+		}
+		if offset == 0 && seq > after+1 {
+			// the snapshot misses writes the log no longer holds
+			return fmt.Errorf("WAL: records %d to %d are missing", after+1, seq-1)
+		}
+		offset += n
+		if seq > w.seq {
+			w.seq = seq
+		}
+		if seq > after {
+			apply(args)
+		}
+	}
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return
+}
+
+func (w *WAL) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Discards the records up to sequence number seq, which a snapshot now holds, keeping the ones
+// appended since. The remaining records are copied to a new file that replaces the log.
+func (w *WAL) Discard(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq >= w.seq {
+		return w.truncate()
+	}
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		s, _, n, err := readRecord(r)
+		if err == io.EOF {
+			return w.truncate()
+		} else if err != nil {
+			return err
+		}
+		if s > seq {
+			break
+		}
+		offset += n
+	}
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(w.name), filepath.Base(w.name)+".tmp")
+	if err != nil {
+		return err
+	}
+	fi, err := w.file.Stat()
+	if err == nil {
+		err = f.Chmod(fi.Mode())
+	}
+	if err == nil {
+		_, err = io.Copy(f, w.file)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), w.name)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(w.name))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		w.file.Seek(0, io.SeekEnd)
+		return err
+	}
+	w.file.Close()
+	w.file = f
+	_, err = w.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Size of the log in bytes.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fi, err := w.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
+
+// Reads a single record. n is the number of bytes consumed.
+func readRecord(r *bufio.Reader) (seq uint64, args []string, n int64, err error) {
+	var header [WAL_HEADER_SIZE]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorruptRecord
+		}
+		return
+	}
+	seq = binary.BigEndian.Uint64(header[0:8])
+	size := binary.BigEndian.Uint32(header[8:12])
+	sum := binary.BigEndian.Uint32(header[12:16])
+	if size > WAL_MAX_RECORD {
+		err = errCorruptRecord
+		return
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		err = errCorruptRecord
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		err = errCorruptRecord
+		return
+	}
+	if args, err = decodeArgs(payload); err != nil {
+		return
+	}
+	n = int64(WAL_HEADER_SIZE + len(payload))
+	return
+}
+
+// Encodes command arguments as a sequence of uvarint length prefixed strings.
+func encodeArgs(args []string) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	for _, a := range args {
+		n := binary.PutUvarint(tmp[:], uint64(len(a)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, a...)
+	}
+	return buf
+}
+
+func decodeArgs(buf []byte) (args []string, err error) {
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return nil, errCorruptRecord
+		}
+		buf = buf[n:]
+		args = append(args, string(buf[:size]))
+		buf = buf[size:]
+	}
+	return
+}
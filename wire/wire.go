@@ -0,0 +1,163 @@
+// Package wire implements the framing used between the godb server and its clients.
+//
+// A connection starts with a handshake: the client sends the 4 byte MAGIC followed by its
+// protocol VERSION as a 4 byte big-endian integer and the server answers with the same
+// 8 bytes carrying its own version. If the versions differ the server closes the connection.
+//
+// After the handshake every request and response is a frame: a 4 byte big-endian payload
+// length followed by the payload. Responses holding several values are encoded with EncodeList.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAGIC   = "GODB"
+	VERSION = 1
+
+	// Default maximum payload size of a frame.
+	MAX_FRAME = 64 << 20
+
+	HEADER_SIZE = 4
+)
+
+var (
+	// Returned when a frame is larger than the maximum size. The payload has been
+	// skipped, so the next frame can still be read.
+	ErrFrameTooLarge = errors.New("wire: frame too large")
+
+	// Returned by ServerHandshake when the peer did not start with MAGIC,
+	// e.g. a client using the old BigRead/BigWrite framing.
+	ErrNotGodb = errors.New("wire: peer does not speak the godb protocol")
+)
+
+// Returned by a handshake when the two sides speak different protocol versions.
+type VersionError struct {
+	Local, Remote uint32
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("wire: protocol version mismatch: local %d, remote %d", e.Local, e.Remote)
+}
+
+// Writes p as a single frame.
+func WriteFrame(w io.Writer, p []byte) error {
+	buf := make([]byte, HEADER_SIZE+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[HEADER_SIZE:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Reads a single frame. Frames with a payload larger than max are discarded and
+// ErrFrameTooLarge is returned.
+func ReadFrame(r io.Reader, max int) ([]byte, error) {
+	var header [HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(max) {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			return nil, err
+		}
+		return nil, ErrFrameTooLarge
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// Performs the client side of the handshake.
+func ClientHandshake(rw io.ReadWriter) error {
+	if _, err := rw.Write(hello(VERSION)); err != nil {
+		return err
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(rw, buf[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:4], []byte(MAGIC)) {
+		return ErrNotGodb
+	}
+	if v := binary.BigEndian.Uint32(buf[4:]); v != VERSION {
+		return &VersionError{VERSION, v}
+	}
+	return nil
+}
+
+// Performs the server side of the handshake.
+// On ErrNotGodb the caller may still write a reply the peer understands before closing.
+func ServerHandshake(rw io.ReadWriter) error {
+	var buf [8]byte
+	if _, err := io.ReadFull(rw, buf[:4]); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:4], []byte(MAGIC)) {
+		return ErrNotGodb
+	}
+	if _, err := io.ReadFull(rw, buf[4:]); err != nil {
+		return err
+	}
+	if _, err := rw.Write(hello(VERSION)); err != nil {
+		return err
+	}
+	if v := binary.BigEndian.Uint32(buf[4:]); v != VERSION {
+		return &VersionError{VERSION, v}
+	}
+	return nil
+}
+
+func hello(version uint32) []byte {
+	buf := make([]byte, 8)
+	copy(buf, MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], version)
+	return buf
+}
+
+// Encodes several responses as one: "L" followed by each response prefixed with its length
+// and a colon, e.g. "L1:12:Rx".
+func EncodeList(items []string) string {
+	var b strings.Builder
+	b.WriteString("L")
+	for _, item := range items {
+		b.WriteString(strconv.Itoa(len(item)))
+		b.WriteString(":")
+		b.WriteString(item)
+	}
+	return b.String()
+}
+
+// Decodes a response written by EncodeList. ok is false if it is not a valid list.
+func DecodeList(s string) (items []string, ok bool) {
+	if !strings.HasPrefix(s, "L") {
+		return nil, false
+	}
+	s = s[1:]
+	for len(s) > 0 {
+		i := strings.Index(s, ":")
+		if i < 0 {
+			return nil, false
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 || n > len(s)-i-1 {
+			return nil, false
+		}
+		items = append(items, s[i+1:i+1+n])
+		s = s[i+1+n:]
+	}
+	return items, true
+}
@@ -0,0 +1,72 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	var b bytes.Buffer
+	big := strings.Repeat("x", 70000) // used to break the old single byte size prefix
+	for _, s := range []string{"", "get a", big, "after"} {
+		if err := WriteFrame(&b, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{"", "get a"} {
+		if p, err := ReadFrame(&b, 1024); err != nil || string(p) != s {
+			t.Fatalf("Expected %q, got %q (%v)", s, p, err)
+		}
+	}
+	if _, err := ReadFrame(&b, 1024); err != ErrFrameTooLarge {
+		t.Fatal("Expected ErrFrameTooLarge, got", err)
+	}
+	if p, err := ReadFrame(&b, 1024); err != nil || string(p) != "after" {
+		t.Fatalf("Stream out of sync after a large frame: %q (%v)", p, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	items := []string{"", "a:b", "L1:x", strings.Repeat("y", 12)}
+	s := EncodeList(items)
+	if s != "L0:3:a:b4:L1:x12:yyyyyyyyyyyy" {
+		t.Fatal("Unexpected encoding", s)
+	}
+	if decoded, ok := DecodeList(s); !ok || strings.Join(decoded, ",") != strings.Join(items, ",") {
+		t.Fatalf("Decoded %q, %v", decoded, ok)
+	}
+	if items, ok := DecodeList("L"); !ok || len(items) != 0 {
+		t.Fatalf("Decoded the empty list as %q, %v", items, ok)
+	}
+	for _, s := range []string{"", "R1", "L1", "L2:a", "L-1:", "Lx:a"} {
+		if _, ok := DecodeList(s); ok {
+			t.Errorf("%q was decoded", s)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error)
+	go func() {
+		done <- ServerHandshake(s)
+	}()
+	if err := ClientHandshake(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// an old client sends its size byte and query instead of MAGIC
+	go func() {
+		c.Write(append([]byte{0}, "get a"...))
+	}()
+	if err := ServerHandshake(s); err != ErrNotGodb {
+		t.Fatal("Expected ErrNotGodb, got", err)
+	}
+}